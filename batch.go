@@ -0,0 +1,89 @@
+package eventbus
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// isBatchFrame reports whether the frame is a JSON array, carrying several
+// messages in one frame.
+func isBatchFrame(body []byte) bool {
+	trimmed := bytes.TrimSpace(body)
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// handleBatch handles each frame of a batch in order. Offsets are committed
+// once every message in the batch has been handled, the highest for each
+// partition, so a failure part way through redelivers the whole batch. In
+// at-most-once mode they are committed before any message is handled instead.
+func (s streaming) handleBatch(eventbus *Eventbus, body []byte) error {
+	var frames []json.RawMessage
+	if err := json.Unmarshal(body, &frames); err != nil {
+		return errors.Wrap(err, "unmarshalling batch in streaming.handleBatch")
+	}
+	if eventbus.deliveryMode == AtMostOnce && eventbus.txHandler == nil {
+		if err := eventbus.commitBatch(batchOffsets(eventbus, frames)); err != nil {
+			return errors.Wrap(err, "storing offsets in streaming.handleBatch")
+		}
+	}
+
+	eventbus.batch = make(PartitionOffsets)
+	defer func() {
+		eventbus.batch = nil
+	}()
+	for _, f := range frames {
+		err := s.handleEvent(eventbus, f)
+		if me, ok := asMessageError(err); ok {
+			err = eventbus.skipMessage(me, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := eventbus.commitBatch(eventbus.batch); err != nil {
+		return errors.Wrap(err, "storing offsets in streaming.handleBatch")
+	}
+	return nil
+}
+
+// batchOffsets returns the highest offset of each allowed partition among the
+// message frames.
+func batchOffsets(eventbus *Eventbus, frames []json.RawMessage) PartitionOffsets {
+	offsets := make(PartitionOffsets)
+	for _, f := range frames {
+		if !isMessageFrame(f) {
+			continue
+		}
+		var meta messageMeta
+		if json.Unmarshal(f, &meta) != nil || !eventbus.partitionAllowed(meta.Partition) {
+			continue
+		}
+		if o, ok := offsets[meta.Partition]; !ok || int64(meta.Offset) > o {
+			offsets[meta.Partition] = int64(meta.Offset)
+		}
+	}
+	return offsets
+}
+
+func (eb *Eventbus) commitBatch(offsets PartitionOffsets) error {
+	for partition, offset := range offsets {
+		if err := eb.commitOffset(partition, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitMessage commits the offset of a message handled by the run loop, or
+// holds it back until the end of the batch being handled.
+func (eb *Eventbus) commitMessage(partition int32, offset int64) error {
+	if eb.batch == nil {
+		return eb.commitOffset(partition, offset)
+	}
+	if o, ok := eb.batch[partition]; !ok || offset > o {
+		eb.batch[partition] = offset
+	}
+	return nil
+}
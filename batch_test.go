@@ -0,0 +1,36 @@
+package eventbus_test
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	eventbus "github.com/luzcn6/event-bus"
+)
+
+func TestBatchFrame(t *testing.T) {
+	s := newSession(t,
+		`[{"offset":3,"partition":0,"body":{}},{"offset":5,"partition":1,"body":{}},{"offset":4,"partition":0,"body":{}},{"offset":2,"partition":1,"body":{}}]`,
+	)
+	store := eventbus.NewInMemoryOffsetStore()
+	var early int32
+	h := &recorder{}
+	h.fail = func(eventbus.Message) error {
+		if storedOffset(store, 0) != -1 || storedOffset(store, 1) != -1 {
+			atomic.StoreInt32(&early, 1)
+		}
+		return nil
+	}
+	eb := newEventbus(t, s.Endpoint(), h, store)
+	run(t, eb)
+
+	waitFor(t, "the batch to be committed", func() bool {
+		return storedOffset(store, 0) == 4 && storedOffset(store, 1) == 5
+	})
+	if got := h.offsets(); !reflect.DeepEqual(got, []int64{3, 5, 4, 2}) {
+		t.Errorf("handled offsets = %v, want [3 5 4 2]", got)
+	}
+	if atomic.LoadInt32(&early) != 0 {
+		t.Error("offsets were committed before the whole batch was handled")
+	}
+}
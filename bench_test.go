@@ -0,0 +1,110 @@
+package eventbus
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+var benchFrame = []byte(`{"offset":12345,"partition":3,"body":{"id":"a1b2c3","amount":42}}`)
+
+// frameUnmarshaler decodes message frames shaped like benchFrame without
+// reflection, standing in for a generated or third-party decoder. Other
+// values are decoded by json.Unmarshal.
+func frameUnmarshaler(data []byte, v interface{}) error {
+	f, ok := v.(*messageFrame)
+	if !ok {
+		return json.Unmarshal(data, v)
+	}
+	offset, err := benchField(data, `"offset":`)
+	if err != nil {
+		return err
+	}
+	partition, err := benchField(data, `"partition":`)
+	if err != nil {
+		return err
+	}
+	body := data[bytes.Index(data, []byte(`"body":`))+len(`"body":`) : len(data)-1]
+	f.Offset = frameOffset(offset)
+	f.Partition = int32(partition)
+	f.Body = append(f.Body[:0], body...)
+	return nil
+}
+
+func benchField(data []byte, key string) (int64, error) {
+	i := bytes.Index(data, []byte(key)) + len(key)
+	j := i
+	for j < len(data) && data[j] >= '0' && data[j] <= '9' {
+		j++
+	}
+	return strconv.ParseInt(string(data[i:j]), 10, 64)
+}
+
+func BenchmarkHandleEvent(b *testing.B) {
+	for _, bm := range []struct {
+		name      string
+		unmarshal Unmarshaler
+	}{
+		{"json.Unmarshal", nil},
+		{"custom", frameUnmarshaler},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			eb := NewEventbus(Config{}, EventHandlerFunc(func(Message) error { return nil }), NewInMemoryOffsetStore())
+			eb.SetUnmarshaler(bm.unmarshal)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := (streaming{}).handleEvent(eb, benchFrame); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReadMessage(b *testing.B) {
+	for _, lowAlloc := range []bool{false, true} {
+		name := "ReadMessage"
+		if lowAlloc {
+			name = "LowAllocReads"
+		}
+		b.Run(name, func(b *testing.B) {
+			n := b.N
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				c, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				for i := 0; i < n; i++ {
+					if c.WriteMessage(websocket.TextMessage, benchFrame) != nil {
+						return
+					}
+				}
+			}))
+			defer srv.Close()
+			c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+
+			eb := NewEventbus(Config{}, EventHandlerFunc(func(Message) error { return nil }), NewInMemoryOffsetStore())
+			eb.SetLowAllocReads(lowAlloc)
+			eb.socket = c
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < n; i++ {
+				if _, err := eb.readMessage(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package eventbus
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WithCircuitBreaker stops consuming for cooldown after threshold consecutive
+// handler errors, to give a failing downstream dependency room to recover.
+// While the circuit is open nothing is read or handled. If the handler error
+// dropped the connection, as it does in AtLeastOnce mode, the client waits
+// before reconnecting; otherwise the connection is kept up with pings and
+// reading resumes on it. Once the cooldown has passed the next message acts as
+// a trial: success closes the circuit, another error opens it for a further
+// cooldown.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(eb *Eventbus) {
+		eb.breakerThreshold = threshold
+		eb.breakerCooldown = cooldown
+	}
+}
+
+// recordHandlerResult tracks consecutive handler errors, opening the circuit
+// when the threshold is reached.
+func (eb *Eventbus) recordHandlerResult(err error) {
+	if err == nil {
+		eb.handlerFailures = 0
+		return
+	}
+	if _, ok := asMessageError(err); ok {
+		return
+	}
+	eb.handlerFailures++
+	if eb.breakerThreshold > 0 && eb.handlerFailures >= eb.breakerThreshold {
+		eb.breakerOpenUntil = eb.clock.Now().Add(eb.breakerCooldown)
+	}
+}
+
+// waitForCircuit blocks while the circuit is open. It returns ErrStopped if
+// the Eventbus is stopped while waiting.
+func (eb *Eventbus) waitForCircuit() error {
+	if remaining := eb.breakerOpenUntil.Sub(eb.clock.Now()); remaining > 0 {
+		select {
+		case <-eb.clock.After(remaining):
+		case <-eb.stop:
+			return ErrStopped
+		}
+	}
+	return nil
+}
+
+// pauseForCircuit holds off reading the next frame while the circuit is open.
+// The connection is kept up by pinging the server every half keep-alive
+// timeout, and the read deadline is restarted when reading resumes. The pause
+// does not count towards the progress timeout. It returns early if the
+// Eventbus is stopped, which also closes the connection.
+func (eb *Eventbus) pauseForCircuit() {
+	remaining := eb.breakerOpenUntil.Sub(eb.clock.Now())
+	if remaining <= 0 {
+		return
+	}
+	defer eb.beginHandling()()
+	defer eb.extendReadDeadline()
+	interval := eb.KeepAliveTimeout / 2
+	for remaining > 0 {
+		wait := remaining
+		if interval > 0 && interval < wait {
+			wait = interval
+		}
+		select {
+		case <-eb.clock.After(wait):
+		case <-eb.stop:
+			return
+		}
+		if remaining = eb.breakerOpenUntil.Sub(eb.clock.Now()); remaining > 0 {
+			if err := eb.Ping(""); err != nil {
+				eb.logError(err)
+			}
+		}
+	}
+}
+
+// readDeadliner is implemented by connections with a read deadline, such as
+// *websocket.Conn.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// extendReadDeadline restarts the keep-alive timeout on the current
+// connection.
+func (eb *Eventbus) extendReadDeadline() {
+	if c, ok := eb.socket.(readDeadliner); ok {
+		c.SetReadDeadline(time.Now().Add(eb.KeepAliveTimeout))
+	}
+}
+
+// A HandlerErrorLimitError ends Run when the handler has failed too many times
+// in a row on the same message, see WithMaxConsecutiveHandlerErrors.
+type HandlerErrorLimitError struct {
+	Partition int32
+	Offset    int64
+	Failures  int
+	// Err is the last handler error.
+	Err error
+}
+
+func (e *HandlerErrorLimitError) Error() string {
+	return fmt.Sprintf("giving up after %d consecutive handler errors at partition %d offset %d: %s", e.Failures, e.Partition, e.Offset, e.Err)
+}
+
+// Unwrap returns the last handler error.
+func (e *HandlerErrorLimitError) Unwrap() error {
+	return e.Err
+}
+
+// WithMaxConsecutiveHandlerErrors makes Run give up with a
+// HandlerErrorLimitError once the handler has failed n times in a row on the
+// same message, a poisoned message that needs a human to look at it. Handler
+// errors otherwise recycle the connection and redeliver the message forever.
+// Zero, the default, never gives up.
+func WithMaxConsecutiveHandlerErrors(n int) Option {
+	return func(eb *Eventbus) {
+		eb.maxHandlerErrors = n
+	}
+}
+
+// checkHandlerErrorLimit counts consecutive failures of the handler on m,
+// returning a HandlerErrorLimitError once the limit is reached.
+func (eb *Eventbus) checkHandlerErrorLimit(m Message, err error) error {
+	if err == nil {
+		eb.poisonFailures = 0
+		return nil
+	}
+	if eb.maxHandlerErrors <= 0 {
+		return nil
+	}
+	if _, ok := asMessageError(err); ok {
+		return nil
+	}
+	if eb.poisonFailures == 0 || eb.poisonPartition != m.Partition || eb.poisonOffset != m.Offset {
+		eb.poisonPartition = m.Partition
+		eb.poisonOffset = m.Offset
+		eb.poisonFailures = 0
+	}
+	eb.poisonFailures++
+	if eb.poisonFailures < eb.maxHandlerErrors {
+		return nil
+	}
+	return &HandlerErrorLimitError{Partition: m.Partition, Offset: m.Offset, Failures: eb.poisonFailures, Err: err}
+}
+
+// asHandlerErrorLimit finds a HandlerErrorLimitError wrapped by
+// github.com/pkg/errors.
+func asHandlerErrorLimit(err error) (*HandlerErrorLimitError, bool) {
+	limit, ok := errors.Cause(err).(*HandlerErrorLimitError)
+	return limit, ok
+}
@@ -0,0 +1,91 @@
+package eventbus
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrAckDeadlineExceeded is returned by a ChannelHandler when a delivery was
+// not acknowledged within the ack deadline.
+var ErrAckDeadlineExceeded = errors.New("ack deadline exceeded")
+
+// A Delivery is a message received from a ChannelHandler. Exactly one of Ack or
+// Nack should be called once the message has been processed.
+type Delivery struct {
+	Message
+	result chan error
+}
+
+// Ack acknowledges the message, allowing its offset to be committed.
+func (d Delivery) Ack() {
+	d.Nack(nil)
+}
+
+// Nack reports that the message could not be processed, err is returned as the
+// handler error so the offset is not committed. Only the first call to Ack or
+// Nack has any effect.
+func (d Delivery) Nack(err error) {
+	select {
+	case d.result <- err:
+	default:
+	}
+}
+
+// ChannelHandler is an EventHandler that passes messages to other goroutines
+// over a channel, to be acknowledged manually. Handle blocks until the message
+// is acknowledged, so offsets only advance past acknowledged messages.
+type ChannelHandler struct {
+	deliveries  chan Delivery
+	ackDeadline time.Duration
+}
+
+// A ChannelOption configures a ChannelHandler.
+type ChannelOption func(*ChannelHandler)
+
+// WithAckDeadline fails a delivery that has not been acknowledged within d of
+// being handled, much like an SQS visibility timeout. The failure is a handler
+// error, so the offset is not committed, the error is logged and the
+// connection is recycled; the unacknowledged message is delivered again after
+// the reconnect. A late Ack is ignored.
+func WithAckDeadline(d time.Duration) ChannelOption {
+	return func(h *ChannelHandler) {
+		h.ackDeadline = d
+	}
+}
+
+// NewChannelHandler creates a new ChannelHandler, with no ack deadline unless
+// one is given.
+func NewChannelHandler(opts ...ChannelOption) *ChannelHandler {
+	h := &ChannelHandler{deliveries: make(chan Delivery)}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// Deliveries returns the channel messages are delivered on.
+func (h *ChannelHandler) Deliveries() <-chan Delivery {
+	return h.deliveries
+}
+
+// Handle implements EventHandler for the ChannelHandler.
+func (h *ChannelHandler) Handle(m Message) error {
+	d := Delivery{Message: m, result: make(chan error, 1)}
+	var deadline <-chan time.Time
+	if h.ackDeadline > 0 {
+		t := time.NewTimer(h.ackDeadline)
+		defer t.Stop()
+		deadline = t.C
+	}
+	select {
+	case h.deliveries <- d:
+	case <-deadline:
+		return ErrAckDeadlineExceeded
+	}
+	select {
+	case err := <-d.result:
+		return err
+	case <-deadline:
+		return ErrAckDeadlineExceeded
+	}
+}
@@ -0,0 +1,23 @@
+package eventbus
+
+import (
+	"time"
+)
+
+// A Clock provides the current time and timers to the Eventbus.
+// The default uses the time package, tests can supply a fake to step through
+// reconnection backoffs without sleeping.
+type Clock interface {
+	Now() time.Time
+	After(time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
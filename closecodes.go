@@ -0,0 +1,48 @@
+package eventbus
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// A TerminalCloseError ends Run when the server closes the connection with
+// one of the codes given to SetTerminalCloseCodes.
+type TerminalCloseError struct {
+	Code int
+	Text string
+	// Err is the close error read from the connection.
+	Err error
+}
+
+func (e *TerminalCloseError) Error() string {
+	return fmt.Sprintf("server closed the connection with terminal code %d: %s", e.Code, e.Text)
+}
+
+// Unwrap returns the close error read from the connection.
+func (e *TerminalCloseError) Unwrap() error {
+	return e.Err
+}
+
+// SetTerminalCloseCodes makes the websocket close codes terminal, for codes
+// such as invalid authentication where reconnecting can never succeed. When
+// the server closes the connection with one of them, Run stops reconnecting
+// and returns a TerminalCloseError on its chan. Other close codes reconnect
+// as the reconnection policy directs. No codes are terminal by default.
+func (eb *Eventbus) SetTerminalCloseCodes(codes []int) {
+	eb.terminalCodes = make(map[int]bool, len(codes))
+	for _, c := range codes {
+		eb.terminalCodes[c] = true
+	}
+}
+
+// terminalClose returns a TerminalCloseError if err is a close with a
+// terminal code.
+func (eb *Eventbus) terminalClose(err error) error {
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || !eb.terminalCodes[ce.Code] {
+		return nil
+	}
+	return &TerminalCloseError{Code: ce.Code, Text: ce.Text, Err: err}
+}
@@ -0,0 +1,334 @@
+package eventbus
+
+import (
+	"fmt"
+	"time"
+)
+
+// DeliveryMode controls whether an offset is committed before or after the
+// EventHandler is called for the message.
+type DeliveryMode int
+
+const (
+	// AtLeastOnce commits the offset after the handler succeeds. A handler
+	// error or a crash before the commit means the message is delivered again,
+	// so handlers should be idempotent. This is the default.
+	AtLeastOnce DeliveryMode = iota
+	// AtMostOnce commits the offset before the handler is called. A message is
+	// never handled twice, but one whose handler fails or is interrupted by a
+	// crash is lost. A handler error is passed to the error logger and the
+	// next message is handled, the connection is not recycled.
+	AtMostOnce
+)
+
+// SetDeliveryMode chooses between at-least-once and at-most-once delivery.
+func (eb *Eventbus) SetDeliveryMode(mode DeliveryMode) {
+	eb.deliveryMode = mode
+}
+
+// A CommitError is returned when a message was handled but its offset could
+// not be stored, as distinct from the handler itself failing.
+type CommitError struct {
+	Partition int32
+	Offset    int64
+	Err       error
+}
+
+func (e *CommitError) Error() string {
+	return fmt.Sprintf("committing offset %d for partition %d: %s", e.Offset, e.Partition, e.Err)
+}
+
+// Unwrap returns the error from the offset store.
+func (e *CommitError) Unwrap() error {
+	return e.Err
+}
+
+// SetCommitRetries configures how many times a failed offset commit is retried
+// in place, waiting delay between attempts, before the connection is recycled.
+// Retrying avoids redelivering a message whose side effects have already
+// happened when the store has a transient failure.
+func (eb *Eventbus) SetCommitRetries(retries int, delay time.Duration) {
+	eb.commitRetries = retries
+	eb.commitRetryDelay = delay
+}
+
+// SetCommitInterval batches offset commits: the latest handled offset for each
+// partition is held in memory and written to the store at most once per
+// interval. Pending offsets are also flushed every interval while idle, when
+// the connection drops, on Flush, and when Run exits, including after Stop,
+// Drain or a panic. A zero interval commits every message, which is the
+// default.
+func (eb *Eventbus) SetCommitInterval(interval time.Duration) {
+	eb.commitInterval = interval
+}
+
+// WithAsyncCommit writes offsets to the store from a background goroutine, so
+// handling the next message does not wait for the store. Offsets are still
+// stored in order, only the latest offset for each partition is written when
+// the store falls behind. A failed write is passed to errHandler, or logged if
+// it is nil, rather than recycling the connection, and retried with the next
+// write. Offsets not yet written when Run exits are flushed before it returns,
+// but a crash can lose them, widening the window of messages delivered again.
+// Combined with SetCommitInterval, the background writes happen at most once
+// per interval. It has no effect when given to Reconfigure.
+func WithAsyncCommit(errHandler func(error)) Option {
+	return func(eb *Eventbus) {
+		eb.asyncCommit = true
+		eb.asyncCommitErrors = errHandler
+	}
+}
+
+// SetCommitNextOffset stores the offset after each handled message, offset+1,
+// rather than the offset of the message itself, for servers that resume from
+// the stored offset inclusively, as Kafka consumers do. The default stores
+// the handled offset, which is what the eventbus-sub consumer protocol
+// expects, and switching an existing consumer over skips or repeats a message
+// per partition. StopAtOffset still takes message offsets, while the commit
+// interceptor, CommitErrors and StoredOffsets see the stored values.
+func (eb *Eventbus) SetCommitNextOffset(enabled bool) {
+	eb.commitNext = enabled
+}
+
+func (eb *Eventbus) commitOffset(partition int32, offset int64) error {
+	if eb.commitNext {
+		offset++
+	}
+	if eb.commitInterval <= 0 && !eb.asyncCommit {
+		return eb.storeOffset(partition, offset)
+	}
+	eb.mu.Lock()
+	if eb.pendingOffsets == nil {
+		eb.pendingOffsets = make(PartitionOffsets)
+	}
+	if pending, ok := eb.pendingOffsets[partition]; !ok || offset > pending {
+		eb.pendingOffsets[partition] = offset
+	}
+	due := eb.clock.Now().Sub(eb.lastFlush) >= eb.commitInterval
+	signal := eb.commitSignal
+	eb.mu.Unlock()
+	if !due {
+		return nil
+	}
+	if signal != nil {
+		select {
+		case signal <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	return eb.flushOffsets()
+}
+
+// startCommitter starts the background goroutine that writes offsets with
+// WithAsyncCommit. The returned func stops it once any write in progress has
+// finished, leaving the remaining offsets to the final flush.
+func (eb *Eventbus) startCommitter() func() {
+	if !eb.asyncCommit {
+		return func() {}
+	}
+	signal := make(chan struct{}, 1)
+	quit := make(chan struct{})
+	exited := make(chan struct{})
+	eb.mu.Lock()
+	eb.commitSignal = signal
+	eb.mu.Unlock()
+	go func() {
+		defer close(exited)
+		for {
+			select {
+			case <-signal:
+			case <-quit:
+				return
+			}
+			if err := eb.flushOffsets(); err != nil {
+				if eb.asyncCommitErrors != nil {
+					eb.asyncCommitErrors(err)
+				} else {
+					eb.logError(err)
+				}
+			}
+		}
+	}()
+	return func() {
+		eb.mu.Lock()
+		eb.commitSignal = nil
+		eb.mu.Unlock()
+		close(quit)
+		<-exited
+	}
+}
+
+// flushOffsets writes any batched offsets to the store. Offsets that could not
+// be written are kept pending unless a newer offset has been recorded since.
+func (eb *Eventbus) flushOffsets() error {
+	eb.mu.Lock()
+	pending := eb.pendingOffsets
+	eb.pendingOffsets = nil
+	eb.lastFlush = eb.clock.Now()
+	eb.mu.Unlock()
+
+	var firstErr error
+	for partition, offset := range pending {
+		err := eb.storeOffset(partition, offset)
+		if err == nil {
+			delete(pending, partition)
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if len(pending) > 0 {
+		eb.mu.Lock()
+		if eb.pendingOffsets == nil {
+			eb.pendingOffsets = make(PartitionOffsets)
+		}
+		for partition, offset := range pending {
+			if _, ok := eb.pendingOffsets[partition]; !ok {
+				eb.pendingOffsets[partition] = offset
+			}
+		}
+		eb.mu.Unlock()
+	}
+	return firstErr
+}
+
+// commitPartitions writes the batched offsets for the partitions to the store
+// now, leaving those for other partitions pending. Offsets that could not be
+// written stay pending.
+func (eb *Eventbus) commitPartitions(partitions []int32) error {
+	eb.mu.Lock()
+	pending := make(PartitionOffsets)
+	for _, p := range partitions {
+		if offset, ok := eb.pendingOffsets[p]; ok {
+			pending[p] = offset
+			delete(eb.pendingOffsets, p)
+		}
+	}
+	eb.mu.Unlock()
+
+	var firstErr error
+	for partition, offset := range pending {
+		if err := eb.storeOffset(partition, offset); err != nil {
+			eb.mu.Lock()
+			if eb.pendingOffsets == nil {
+				eb.pendingOffsets = make(PartitionOffsets)
+			}
+			if _, ok := eb.pendingOffsets[partition]; !ok {
+				eb.pendingOffsets[partition] = offset
+			}
+			eb.mu.Unlock()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// storeOffset writes the offset to the store. Offsets only move forward: an
+// offset at or before the last one stored for the partition is dropped, so a
+// late commit can never rewind a partition.
+func (eb *Eventbus) storeOffset(partition int32, offset int64) error {
+	eb.commitMu.Lock()
+	defer eb.commitMu.Unlock()
+	requested := offset
+	eb.mu.Lock()
+	resetting := eb.resetting
+	eb.mu.Unlock()
+	if resetting {
+		return nil
+	}
+	if eb.commitInterceptor != nil {
+		var proceed bool
+		offset, proceed = eb.commitInterceptor(partition, offset)
+		if !proceed {
+			return nil
+		}
+	}
+	if last, ok := eb.committedOffsets[partition]; ok && offset <= last {
+		return nil
+	}
+	err := eb.setOffset(partition, offset)
+	for i := 0; err != nil && i < eb.commitRetries; i++ {
+		<-eb.clock.After(eb.commitRetryDelay)
+		err = eb.setOffset(partition, offset)
+	}
+	if err != nil {
+		err = &CommitError{Partition: partition, Offset: offset, Err: err}
+		eb.notCommitted(partition, offset, CommitFailed, err)
+		return err
+	}
+	if eb.committedOffsets == nil {
+		eb.committedOffsets = make(PartitionOffsets)
+	}
+	eb.committedOffsets[partition] = offset
+	eb.checkStopTarget(partition, requested)
+	return nil
+}
+
+// SetCommitInterceptor sets a function called with each offset about to be
+// stored, returning the offset to store in its place and whether to store it
+// at all, to round offsets, change their representation or hold commits back
+// during a maintenance window. A vetoed commit is dropped rather than retried,
+// the next commit for the partition stores a later offset. A nil interceptor,
+// the default, stores every offset unchanged.
+func (eb *Eventbus) SetCommitInterceptor(f func(partition int32, offset int64) (int64, bool)) {
+	eb.commitInterceptor = f
+}
+
+// SetCommitMetadata records the commit time and the ID of the server the
+// client was connected to alongside each offset, to help work out where a
+// consumer was. It only has an effect with stores that support metadata, such
+// as the RedisOffsetStore, and is off by default.
+func (eb *Eventbus) SetCommitMetadata(enabled bool) {
+	eb.commitMetadata = enabled
+}
+
+func (eb *Eventbus) setOffset(partition int32, offset int64) error {
+	if o, ok := eb.metrics.(commitDurationObserver); ok {
+		start := eb.clock.Now()
+		defer func() { o.ObserveCommitDuration(eb.clock.Now().Sub(start)) }()
+	}
+	if ms, ok := eb.store.(offsetMetaStore); ok && eb.commitMetadata {
+		return ms.SetOffsetWithMeta(partition, offset, map[string]string{
+			"committed_at": eb.clock.Now().UTC().Format(time.RFC3339Nano),
+			"server_id":    eb.serverID,
+		})
+	}
+	return eb.store.SetOffset(partition, offset)
+}
+
+// StopAtOffset bounds a replay: once offsets up to offset have been committed
+// for the partition, and for every other partition given to StopAtOffset, the
+// run loop stops as if Stop had been called. Run then closes its chan without
+// an error and RunBlocking returns nil. An offset only counts once it has been
+// written to the store, so a failed commit does not stop the loop and, with
+// SetCommitInterval, the loop stops when the offset is flushed.
+func (eb *Eventbus) StopAtOffset(partition int32, offset int64) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	if eb.stopTargets == nil {
+		eb.stopTargets = make(PartitionOffsets)
+	}
+	eb.stopTargets[partition] = offset
+}
+
+// checkStopTarget records the stored offset against the StopAtOffset targets,
+// stopping once they have all been reached. With SetCommitNextOffset the
+// offset stored is one past the message committed.
+func (eb *Eventbus) checkStopTarget(partition int32, offset int64) {
+	if eb.commitNext {
+		offset--
+	}
+	eb.mu.Lock()
+	target, ok := eb.stopTargets[partition]
+	if !ok || offset < target {
+		eb.mu.Unlock()
+		return
+	}
+	delete(eb.stopTargets, partition)
+	done := len(eb.stopTargets) == 0
+	eb.mu.Unlock()
+	if done {
+		eb.requestStop(false)
+	}
+}
@@ -0,0 +1,72 @@
+package eventbus
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// monotonicStore records writes that move a partition backwards.
+type monotonicStore struct {
+	mu        sync.Mutex
+	offsets   PartitionOffsets
+	rewound   int
+	completed int
+}
+
+func (s *monotonicStore) SetOffset(partition int32, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if last, ok := s.offsets[partition]; ok && offset < last {
+		s.rewound++
+	}
+	s.offsets[partition] = offset
+	s.completed++
+	return nil
+}
+
+func (s *monotonicStore) GetOffsets() (*PartitionOffsets, error) {
+	return nil, nil
+}
+
+func TestCommitsNeverRewind(t *testing.T) {
+	for _, interval := range []bool{false, true} {
+		store := &monotonicStore{offsets: make(PartitionOffsets)}
+		eb := NewEventbus(Config{}, EventHandlerFunc(func(Message) error { return nil }), store)
+		if interval {
+			eb.SetCommitInterval(1)
+		}
+
+		const partitions, perPartition = 4, 500
+		var wg sync.WaitGroup
+		for p := int32(0); p < partitions; p++ {
+			offsets := rand.Perm(perPartition)
+			for w := 0; w < 4; w++ {
+				wg.Add(1)
+				go func(p int32, offsets []int) {
+					defer wg.Done()
+					for _, o := range offsets {
+						if err := eb.commitOffset(p, int64(o)); err != nil {
+							t.Error(err)
+						}
+					}
+				}(p, offsets[w*perPartition/4:(w+1)*perPartition/4])
+			}
+		}
+		wg.Wait()
+		if err := eb.flushOffsets(); err != nil {
+			t.Fatal(err)
+		}
+
+		store.mu.Lock()
+		if store.rewound > 0 {
+			t.Errorf("interval %v: %d of %d writes moved a partition backwards", interval, store.rewound, store.completed)
+		}
+		for p := int32(0); p < partitions; p++ {
+			if got := store.offsets[p]; got != perPartition-1 {
+				t.Errorf("interval %v: partition %d offset = %d, want %d", interval, p, got, perPartition-1)
+			}
+		}
+		store.mu.Unlock()
+	}
+}
@@ -0,0 +1,164 @@
+package eventbus_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	eventbus "github.com/luzcn6/event-bus"
+	"github.com/luzcn6/event-bus/eventbustest"
+)
+
+func TestAtMostOnceHandlerError(t *testing.T) {
+	s := newSession(t,
+		`{"offset":1,"partition":0,"body":{}}`,
+		`{"offset":2,"partition":0,"body":{}}`,
+	)
+	h := &recorder{fail: func(m eventbus.Message) error {
+		if m.Offset == 1 {
+			return errors.New("downstream unavailable")
+		}
+		return nil
+	}}
+	store := eventbus.NewInMemoryOffsetStore()
+	errs := make(chan error, 10)
+	eb := newEventbus(t, s.Endpoint(), h, store, eventbus.WithErrorChannel(errs))
+	eb.SetDeliveryMode(eventbus.AtMostOnce)
+	run(t, eb)
+
+	waitFor(t, "offset 2 to be handled", func() bool { return len(h.offsets()) == 2 })
+	if got := h.offsets(); !reflect.DeepEqual(got, []int64{1, 2}) {
+		t.Errorf("handled offsets = %v, want [1 2]", got)
+	}
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "downstream unavailable") {
+			t.Errorf("logged %v, want the handler error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler error was not logged")
+	}
+	if got := storedOffset(store, 0); got != 2 {
+		t.Errorf("stored offset = %d, want 2", got)
+	}
+	if n := eb.ReconnectAttempts(); n != 0 {
+		t.Errorf("ReconnectAttempts() = %d, want 0", n)
+	}
+}
+
+func TestAtMostOnceCircuitBreaker(t *testing.T) {
+	s := newSession(t,
+		`{"offset":1,"partition":0,"body":{}}`,
+		`{"offset":2,"partition":0,"body":{}}`,
+	)
+	h := &recorder{fail: func(m eventbus.Message) error {
+		if m.Offset == 1 {
+			return errors.New("downstream unavailable")
+		}
+		return nil
+	}}
+	clock := eventbustest.NewFakeClock(time.Unix(0, 0))
+	store := eventbus.NewInMemoryOffsetStore()
+	eb := newEventbus(t, s.Endpoint(), h, store, eventbus.WithCircuitBreaker(1, 10*time.Second))
+	eb.SetClock(clock)
+	eb.SetDeliveryMode(eventbus.AtMostOnce)
+	run(t, eb)
+
+	waitFor(t, "the circuit to open", func() bool {
+		d, ok := clock.NextWake()
+		return ok && d == 10*time.Second
+	})
+	if got := h.offsets(); !reflect.DeepEqual(got, []int64{1}) {
+		t.Errorf("handled offsets while open = %v, want [1]", got)
+	}
+	if got := storedOffset(store, 0); got != 1 {
+		t.Errorf("stored offset while open = %d, want 1", got)
+	}
+
+	clock.Advance(10 * time.Second)
+	waitFor(t, "offset 2 to be committed", func() bool { return storedOffset(store, 0) == 2 })
+	if got := h.offsets(); !reflect.DeepEqual(got, []int64{1, 2}) {
+		t.Errorf("handled offsets = %v, want [1 2]", got)
+	}
+	if n := eb.ReconnectAttempts(); n != 0 {
+		t.Errorf("ReconnectAttempts() = %d, want 0", n)
+	}
+}
+
+// flakyStore fails the first fails writes, then stores offsets in memory.
+type flakyStore struct {
+	mu    sync.Mutex
+	fails int
+	store *eventbus.InMemoryOffsetStore
+}
+
+func (s *flakyStore) SetOffset(partition int32, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fails > 0 {
+		s.fails--
+		return errors.New("store unavailable")
+	}
+	return s.store.SetOffset(partition, offset)
+}
+
+func (s *flakyStore) GetOffsets() (*eventbus.PartitionOffsets, error) {
+	return s.store.GetOffsets()
+}
+
+func TestStopAtOffsetWaitsForCommit(t *testing.T) {
+	s := newSession(t, `{"offset":1,"partition":0,"body":{}}`)
+	store := &flakyStore{fails: 1, store: eventbus.NewInMemoryOffsetStore()}
+	eb := eventbus.NewEventbus(eventbus.Config{Endpoint: s.Endpoint(), Stream: "stream"}, &recorder{}, store)
+	eb.Reconnection = eventbus.NewConstantReconnectionPolicy(0).NewScheduler()
+	eb.SetErrorLogger(func(err error) { t.Log("eventbus:", err) })
+	eb.StopAtOffset(0, 1)
+	done := run(t, eb)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the loop did not stop at the target offset")
+	}
+	if got := storedOffset(store.store, 0); got != 1 {
+		t.Errorf("stored offset = %d, want the loop to stop only once 1 is stored", got)
+	}
+}
+
+func TestCommitNextOffset(t *testing.T) {
+	tests := []struct {
+		name string
+		next bool
+		want int64
+	}{
+		{"handled offset", false, 7},
+		{"next offset", true, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSession(t, `{"offset":7,"partition":0,"body":{}}`)
+			store := eventbus.NewInMemoryOffsetStore()
+			eb := newEventbus(t, s.Endpoint(), &recorder{}, store)
+			eb.SetCommitNextOffset(tt.next)
+			run(t, eb)
+
+			waitFor(t, "the offset to be committed", func() bool { return storedOffset(store, 0) != -1 })
+			if got := storedOffset(store, 0); got != tt.want {
+				t.Errorf("stored offset = %d, want %d", got, tt.want)
+			}
+			offsets, err := eb.StoredOffsets()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := offsets[0]; got != tt.want {
+				t.Errorf("StoredOffsets()[0] = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,6 +2,16 @@ package eventbus
 
 // These numbers come from https://github.com/Shopify/sarama/blob/master/client.go
 const (
+	// OffsetNewest starts consuming from the next message published, skipping
+	// everything already in the stream.
 	OffsetNewest int64 = -1
+	// OffsetOldest starts consuming from the oldest message still retained in
+	// the stream. It is the default starting offset.
 	OffsetOldest int64 = -2
 )
+
+// validStartingOffset reports whether offset is OffsetNewest, OffsetOldest or
+// an absolute offset.
+func validStartingOffset(offset int64) bool {
+	return offset == OffsetNewest || offset == OffsetOldest || offset >= 0
+}
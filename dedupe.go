@@ -0,0 +1,70 @@
+package eventbus
+
+import (
+	"container/list"
+)
+
+// A DedupeKeyFunc returns the business key identifying the event in a
+// message, and false if the message has none.
+type DedupeKeyFunc func(Message) (string, bool)
+
+// SetDedupeKeyFunc suppresses messages carrying the same key as one of the
+// last window messages handled, such as events redelivered by a producer.
+// Unlike SeenBefore, keys are compared across partitions and reconnects.
+// A duplicate is not passed to the handler, but its offset is committed.
+// A nil f turns deduplication off, which is the default.
+func (eb *Eventbus) SetDedupeKeyFunc(f DedupeKeyFunc, window int) {
+	if f == nil || window <= 0 {
+		eb.dedupeKey = nil
+		eb.dedupe = nil
+		return
+	}
+	eb.dedupeKey = f
+	eb.dedupe = newKeyLRU(window)
+}
+
+// duplicateKey returns the dedupe key of the message, if it has one, and
+// whether the key has been seen recently.
+func (eb *Eventbus) duplicateKey(m Message) (key string, ok, dup bool) {
+	if eb.dedupeKey == nil {
+		return "", false, false
+	}
+	key, ok = eb.dedupeKey(m)
+	if !ok {
+		return "", false, false
+	}
+	return key, true, eb.dedupe.contains(key)
+}
+
+// keyLRU holds the most recently added keys, up to size.
+type keyLRU struct {
+	size  int
+	order *list.List
+	keys  map[string]*list.Element
+}
+
+func newKeyLRU(size int) *keyLRU {
+	return &keyLRU{
+		size:  size,
+		order: list.New(),
+		keys:  make(map[string]*list.Element, size),
+	}
+}
+
+func (l *keyLRU) contains(key string) bool {
+	_, ok := l.keys[key]
+	return ok
+}
+
+func (l *keyLRU) add(key string) {
+	if e, ok := l.keys[key]; ok {
+		l.order.MoveToFront(e)
+		return
+	}
+	l.keys[key] = l.order.PushFront(key)
+	if l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.keys, oldest.Value.(string))
+	}
+}
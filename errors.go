@@ -0,0 +1,115 @@
+package eventbus
+
+import (
+	stderrors "errors"
+	"fmt"
+)
+
+var (
+	// ErrDrop can be returned by a handler to discard a message on purpose.
+	// The offset is committed and the client moves on, as if the handler had
+	// succeeded.
+	ErrDrop = stderrors.New("drop message")
+	// ErrSkipCommit can be returned by a handler to move on to the next
+	// message without committing the offset or reconnecting. A later commit
+	// on the same partition still moves past it.
+	ErrSkipCommit = stderrors.New("skip commit")
+)
+
+// A MessageError is a failure confined to a single message, such as a body
+// that cannot be decoded. Other errors from handling a frame recycle the
+// connection, a MessageError is logged and the message skipped instead, so one
+// bad message cannot cause a reconnect storm. Handlers can return a
+// MessageError, directly or wrapped, for failures that retrying will not fix.
+type MessageError struct {
+	Partition int32
+	Offset    int64
+	Err       error
+}
+
+func (e *MessageError) Error() string {
+	return fmt.Sprintf("skipping message at partition %d offset %d: %s", e.Partition, e.Offset, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *MessageError) Unwrap() error {
+	return e.Err
+}
+
+// asMessageError finds a MessageError wrapped by either the errors package or
+// github.com/pkg/errors, in any combination.
+func asMessageError(err error) (*MessageError, bool) {
+	var me *MessageError
+	found := walkErrors(err, func(e error) bool {
+		me, _ = e.(*MessageError)
+		return me != nil
+	})
+	return me, found
+}
+
+// isError reports whether err is target or wraps it, as for asMessageError.
+func isError(err, target error) bool {
+	return walkErrors(err, func(e error) bool {
+		return e == target
+	})
+}
+
+// walkErrors calls f with err and each error it wraps until f returns true.
+// Each step follows Unwrap, or Cause for github.com/pkg/errors, whose v0.8.1
+// wrappers have no Unwrap, so errors.As and errors.Cause each stop at the
+// other package's wrappers.
+func walkErrors(err error, f func(error) bool) bool {
+	for err != nil {
+		if f(err) {
+			return true
+		}
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		case interface{ Cause() error }:
+			err = e.Cause()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// SetCommitSkippedMessages commits the offsets of messages skipped because of a
+// MessageError, so they are not delivered again. By default they are not
+// committed and are redelivered after the next reconnect.
+func (eb *Eventbus) SetCommitSkippedMessages(commit bool) {
+	eb.commitSkipped = commit
+}
+
+// skipMessage logs a message level error and moves on to the next message.
+func (eb *Eventbus) skipMessage(me *MessageError, err error) error {
+	eb.logError(err)
+	if !eb.commitSkipped {
+		eb.notCommitted(me.Partition, me.Offset, MessageSkipped, err)
+		return nil
+	}
+	return eb.commitMessage(me.Partition, me.Offset)
+}
+
+type outcome int
+
+const (
+	handled outcome = iota
+	dropped
+	skipped
+)
+
+// handlerOutcome interprets ErrDrop and ErrSkipCommit, which are not handler
+// failures, returning a nil error for them.
+func handlerOutcome(err error) (outcome, error) {
+	switch {
+	case err == nil:
+		return handled, nil
+	case isError(err, ErrDrop):
+		return dropped, nil
+	case isError(err, ErrSkipCommit):
+		return skipped, nil
+	}
+	return handled, err
+}
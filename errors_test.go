@@ -0,0 +1,118 @@
+package eventbus_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	eventbus "github.com/luzcn6/event-bus"
+)
+
+func TestMessageErrorSkipsMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		err  func(m eventbus.Message) error
+	}{
+		{"direct", func(m eventbus.Message) error {
+			return &eventbus.MessageError{Partition: m.Partition, Offset: m.Offset, Err: errors.New("bad")}
+		}},
+		{"wrapped", func(m eventbus.Message) error {
+			return fmt.Errorf("processing: %w", &eventbus.MessageError{Partition: m.Partition, Offset: m.Offset, Err: errors.New("bad")})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSession(t,
+				`{"offset":1,"partition":0,"body":{}}`,
+				`{"offset":2,"partition":0,"body":{}}`,
+			)
+			h := &recorder{fail: func(m eventbus.Message) error {
+				if m.Offset == 1 {
+					return tt.err(m)
+				}
+				return nil
+			}}
+			store := eventbus.NewInMemoryOffsetStore()
+			eb := newEventbus(t, s.Endpoint(), h, store)
+			eb.SetCommitSkippedMessages(true)
+			run(t, eb)
+
+			waitFor(t, "offset 2 to be committed", func() bool { return storedOffset(store, 0) == 2 })
+			if got := h.offsets(); !reflect.DeepEqual(got, []int64{1, 2}) {
+				t.Errorf("handled offsets = %v, want [1 2]", got)
+			}
+			if n := eb.ReconnectAttempts(); n != 0 {
+				t.Errorf("ReconnectAttempts() = %d, want 0", n)
+			}
+		})
+	}
+}
+
+func TestHandlerErrorRecyclesConnection(t *testing.T) {
+	s := newSession(t, `{"offset":1,"partition":0,"body":{}}`)
+	failed := false
+	h := &recorder{fail: func(m eventbus.Message) error {
+		if !failed {
+			failed = true
+			return errors.New("downstream unavailable")
+		}
+		return nil
+	}}
+	store := eventbus.NewInMemoryOffsetStore()
+	eb := newEventbus(t, s.Endpoint(), h, store)
+	run(t, eb)
+
+	waitFor(t, "offset 1 to be committed", func() bool { return storedOffset(store, 0) == 1 })
+	if got := h.offsets(); !reflect.DeepEqual(got, []int64{1, 1}) {
+		t.Errorf("handled offsets = %v, want the message redelivered as [1 1]", got)
+	}
+	if n := eb.ReconnectAttempts(); n != 1 {
+		t.Errorf("ReconnectAttempts() = %d, want 1", n)
+	}
+}
+
+func TestHandlerOutcomes(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStored int64
+		wantOffset []int64
+		reconnects int
+	}{
+		{"success", nil, 1, []int64{1, 2}, 0},
+		{"ErrDrop", fmt.Errorf("ignoring: %w", eventbus.ErrDrop), 1, []int64{1, 2}, 0},
+		{"ErrSkipCommit", eventbus.ErrSkipCommit, -1, []int64{1, 2}, 0},
+		{"failure", errors.New("downstream unavailable"), 1, []int64{1, 1, 2}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSession(t,
+				`{"offset":1,"partition":0,"body":{}}`,
+				`{"offset":2,"partition":1,"body":{}}`,
+			)
+			failed := false
+			h := &recorder{fail: func(m eventbus.Message) error {
+				if m.Offset == 1 && !failed {
+					failed = true
+					return tt.err
+				}
+				return nil
+			}}
+			store := eventbus.NewInMemoryOffsetStore()
+			eb := newEventbus(t, s.Endpoint(), h, store)
+			run(t, eb)
+
+			waitFor(t, "partition 1 to be committed", func() bool { return storedOffset(store, 1) == 2 })
+			if got := storedOffset(store, 0); got != tt.wantStored {
+				t.Errorf("stored offset of partition 0 = %d, want %d", got, tt.wantStored)
+			}
+			if got := h.offsets(); !reflect.DeepEqual(got, tt.wantOffset) {
+				t.Errorf("handled offsets = %v, want %v", got, tt.wantOffset)
+			}
+			if n := eb.ReconnectAttempts(); n != tt.reconnects {
+				t.Errorf("ReconnectAttempts() = %d, want %d", n, tt.reconnects)
+			}
+		})
+	}
+}
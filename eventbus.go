@@ -1,12 +1,16 @@
 package eventbus
 
 import (
-	"encoding/base64"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
+	"net/url"
+	"runtime/debug"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -14,6 +18,26 @@ import (
 
 const DefaultKeepAliveTimeout = time.Second * 30
 
+const controlWriteTimeout = time.Second
+
+var (
+	// ErrNotConnected is returned when an operation needs a connection to
+	// eventbus-sub and there is none.
+	ErrNotConnected = errors.New("not connected")
+	// ErrResetUnsupported is returned when resetting offsets with a store that
+	// cannot discard them.
+	ErrResetUnsupported = errors.New("offset store does not support reset")
+	// ErrStopped is returned by WaitReady when the run loop exited without an
+	// error, and internally to abandon a connection attempt when stopping.
+	ErrStopped = errors.New("eventbus stopped")
+	// ErrInvalidOffset is returned by StartAtOffset for an offset that is
+	// neither a sentinel nor an absolute offset.
+	ErrInvalidOffset = errors.New("invalid starting offset")
+	// ErrAlreadyRunning is returned by RunBlocking when the Eventbus has
+	// already been started.
+	ErrAlreadyRunning = errors.New("eventbus already running")
+)
+
 // An EventHandler responds to an event.
 // If the Handle call returns an error, then the offset will not be recorded as
 // processed.
@@ -32,24 +56,157 @@ func (e EventHandlerFunc) Handle(m Message) error {
 
 // An Eventbus is the client for connecting to eventbus-sub.
 type Eventbus struct {
-	config           Config
-	state            eventbusState
-	socket           socketClient
-	eventHandler     EventHandler
-	dialer           dialer
-	store            offsetStore
-	Reconnection     ReconnectionScheduler
-	startingOffset   int64
-	KeepAliveTimeout time.Duration
-	errorLogger      func(e error)
+	mu       sync.Mutex
+	commitMu sync.Mutex
+	writeMu  sync.Mutex
+	logMu    sync.RWMutex // guards errorLogger, errorDedup and errorChan
+
+	config             Config
+	state              eventbusState
+	socket             socketClient
+	eventHandler       EventHandler
+	partitionHandlers  map[int32]EventHandler
+	txHandler          TransactionalEventHandler
+	rawHandler         RawEventHandler
+	rawFrame           []byte
+	inFlight           *Message
+	onNotCommitted     func(partition int32, offset int64, reason NotCommittedReason, err error)
+	onAssigned         func(partitions []int32)
+	onRevoked          func(partitions []int32)
+	onConnect          func() error
+	panicHandler       func(recovered interface{}, stack []byte)
+	dialer             Dialer
+	proxy              func(*http.Request) (*url.URL, error)
+	clock              Clock
+	store              offsetStore
+	offsetEncoder      OffsetEncoder
+	Reconnection       ReconnectionScheduler
+	startingOffset     int64
+	nextStart          *int64
+	KeepAliveTimeout   time.Duration
+	errorLogger        func(e error)
+	debugLogger        func(format string, args ...interface{})
+	pendingOptions     []Option
+	pingHandler        func(appData string) error
+	pongHandler        func(appData string) error
+	heartbeatInterval  time.Duration
+	heartbeatPayload   func() []byte
+	stopHeartbeats     chan struct{}
+	maxConnectionAge   time.Duration
+	stopRotating       chan struct{}
+	progressTimeout    time.Duration
+	progressReconnect  bool
+	progressAt         time.Time
+	handling           bool
+	stopWatchdogs      chan struct{}
+	validateBodies     bool
+	unmarshal          Unmarshaler
+	customUnmarshal    bool
+	metaFilter         func(partition int32, offset int64, stream string) bool
+	allowedPartitions  map[int32]bool
+	targetedReads      bool
+	terminalCodes      map[int]bool
+	fillPartitions     []int32
+	dedupeKey          DedupeKeyFunc
+	dedupe             *keyLRU
+	metrics            Metrics
+	stats              *connStats
+	dialledAt          time.Time
+	prefetch           int
+	lowAllocReads      bool
+	readBuf            bytes.Buffer
+	maxBacklog         int
+	frameAliases       map[string]string
+	frames             chan frame
+	stopFrames         chan struct{}
+	backlog            []queuedFrame
+	partitionPriority  map[int32]int
+	errorDedup         *errorDeduplicator
+	errorChan          chan error
+	commitRetries      int
+	commitRetryDelay   time.Duration
+	commitInterval     time.Duration
+	asyncCommit        bool
+	asyncCommitErrors  func(error)
+	commitSignal       chan struct{}
+	deliveryMode       DeliveryMode
+	commitMetadata     bool
+	commitNext         bool
+	commitInterceptor  func(partition int32, offset int64) (int64, bool)
+	commitSkipped      bool
+	breakerThreshold   int
+	breakerCooldown    time.Duration
+	breakerOpenUntil   time.Time
+	handlerFailures    int
+	maxHandlerErrors   int
+	poisonPartition    int32
+	poisonOffset       int64
+	poisonFailures     int
+	serverID           string
+	serverVersion      string
+	serverCaps         map[string]bool
+	handshakeResponse  http.Header
+	lastHandshakeState *HandshakeState
+	recordHandshake    bool
+	transcript         []TranscriptFrame
+	batch              PartitionOffsets
+	pendingOffsets     PartitionOffsets
+	handledOffsets     PartitionOffsets
+	committedOffsets   PartitionOffsets
+	deliveredOffsets   PartitionOffsets
+	strictOrdering     bool
+	resetting          bool
+	reconnectRequested bool
+	lastFlush          time.Time
+
+	endpoint            string
+	remoteAddr          string
+	endpointIndex       int
+	dialled             bool
+	firstConnectNow     bool
+	handshakeRetries    int
+	handshakeRetryDelay time.Duration
+	handshakeFailures   int
+	redialAfter         *time.Duration
+	reconnects          int
+	consecutiveFailures int
+	exhausted           bool
+
+	ready       chan struct{}
+	readyOnce   sync.Once
+	runOnce     sync.Once
+	done        chan error
+	started     bool
+	stopping    bool
+	stopTargets PartitionOffsets
+	draining    bool
+	stop        chan struct{}
+	stopOnce    sync.Once
+	closeOnce   sync.Once
+	exited      chan struct{}
+	exitErr     error
 }
 
 func (eb *Eventbus) sendBytes(data []byte) error {
-	return eb.socket.WriteMessage(websocket.TextMessage, data)
+	eb.recordFrame(true, data)
+	return eb.writeMessage(eb.socket, data)
 }
 
 func (eb *Eventbus) setState(s eventbusState) {
+	eb.mu.Lock()
 	eb.state = s
+	eb.mu.Unlock()
+}
+
+// State returns the name of the state the client is in, one of
+// StateDisconnected, StateConnecting, StateReady or StateStreaming.
+func (eb *Eventbus) State() string {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	if eb.state == nil {
+		return StateDisconnected
+	}
+	return eb.state.String()
 }
 
 // StartAtNewest sets the offset to request from the most recent offsets, rather
@@ -58,26 +215,246 @@ func (eb *Eventbus) StartAtNewest() {
 	eb.startingOffset = OffsetNewest
 }
 
+// StartAtOffset sets the offset to request when no offsets have been
+// committed: OffsetOldest, OffsetNewest or an absolute offset, which is
+// passed to the server as is. Any other value returns ErrInvalidOffset and
+// leaves the starting offset unchanged.
+func (eb *Eventbus) StartAtOffset(offset int64) error {
+	if !validStartingOffset(offset) {
+		return fmt.Errorf("%w: %d", ErrInvalidOffset, offset)
+	}
+	eb.mu.Lock()
+	eb.startingOffset = offset
+	eb.mu.Unlock()
+	return nil
+}
+
+// StartNextAt makes the next handshake request offset, as StartAtOffset
+// would, ignoring the offsets in the store. It is one-shot: the handshake
+// after that resumes from the store again. The store is not modified, and
+// since committed offsets only move forward, replaying messages from before
+// an offset this client has committed does not rewind it.
+// It returns ErrInvalidOffset for an offset StartAtOffset would reject.
+func (eb *Eventbus) StartNextAt(offset int64) error {
+	if !validStartingOffset(offset) {
+		return fmt.Errorf("%w: %d", ErrInvalidOffset, offset)
+	}
+	eb.mu.Lock()
+	eb.nextStart = &offset
+	eb.mu.Unlock()
+	return nil
+}
+
+// ResetToOldest discards all committed progress and reconnects, consuming the
+// stream again from the oldest offsets. Pending batched commits are dropped,
+// and no offsets are committed until the new connection is made.
+// It returns ErrResetUnsupported if the offset store cannot be reset.
+func (eb *Eventbus) ResetToOldest() error {
+	return eb.resetTo(OffsetOldest)
+}
+
+// ResetToNewest discards all committed progress and reconnects, consuming only
+// new messages. Pending batched commits are dropped, and no offsets are
+// committed until the new connection is made.
+// It returns ErrResetUnsupported if the offset store cannot be reset.
+func (eb *Eventbus) ResetToNewest() error {
+	return eb.resetTo(OffsetNewest)
+}
+
+func (eb *Eventbus) resetTo(offset int64) error {
+	resetter, ok := eb.store.(offsetResetter)
+	if !ok {
+		return ErrResetUnsupported
+	}
+	eb.commitMu.Lock()
+	defer eb.commitMu.Unlock()
+	eb.mu.Lock()
+	eb.startingOffset = offset
+	eb.pendingOffsets = nil
+	eb.handledOffsets = nil
+	eb.committedOffsets = nil
+	eb.resetting = true
+	eb.mu.Unlock()
+	if err := resetter.ResetOffsets(); err != nil {
+		return err
+	}
+	eb.requestReconnect()
+	return nil
+}
+
+// connect dials eventbus-sub, waiting before each attempt as the reconnection
+// scheduler directs. A failed dial is logged and retried, so connect only
+// fails once the scheduler gives up, with its error, or the Eventbus is
+// stopped.
 func (eb *Eventbus) connect() error {
-	eb.state = connecting{}
-	reconnectTimeout, exit := eb.Reconnection.NextReconnectBackoff()
-	if exit != nil {
-		return exit
+	for {
+		if err := eb.waitToDial(); err != nil {
+			return err
+		}
+		endpoint := eb.dialEndpoint()
+		c, err := eb.dial(endpoint)
+		if err == nil {
+			eb.mu.Lock()
+			eb.endpoint = endpoint
+			eb.remoteAddr = c.RemoteAddr().String()
+			eb.mu.Unlock()
+			eb.stats.connected()
+			eb.mu.Lock()
+			eb.socket = c
+			// A reset made before now is in this connection's handshake, so
+			// its commits are kept.
+			eb.resetting = false
+			eb.mu.Unlock()
+			eb.startTranscript()
+			eb.startRotation(c)
+			return nil
+		}
+		eb.logError(err)
+		eb.setState(nil)
+		eb.mu.Lock()
+		eb.consecutiveFailures++
+		eb.endpointIndex++
+		eb.mu.Unlock()
+	}
+}
+
+// waitToDial waits out the reconnection backoff and any open circuit.
+func (eb *Eventbus) waitToDial() error {
+	eb.setState(connecting{})
+	eb.mu.Lock()
+	first := !eb.dialled
+	if eb.dialled {
+		eb.reconnects++
+	}
+	eb.dialled = true
+	eb.mu.Unlock()
+	if first && eb.firstConnectNow {
+		return nil
+	}
+	reconnectTimeout, quick := eb.redialDelay()
+	if !quick {
+		var exit error
+		reconnectTimeout, exit = eb.Reconnection.NextReconnectBackoff()
+		if exit != nil {
+			eb.mu.Lock()
+			eb.exhausted = true
+			eb.mu.Unlock()
+			return exit
+		}
+	}
+	select {
+	case <-eb.clock.After(reconnectTimeout):
+	case <-eb.stop:
+		return ErrStopped
+	}
+	return eb.waitForCircuit()
+}
+
+// dialEndpoint returns the endpoint to dial next, rotating through the
+// configured endpoints as dials fail.
+func (eb *Eventbus) dialEndpoint() string {
+	endpoints := eb.config.endpoints()
+	if len(endpoints) == 0 {
+		return ""
+	}
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	return endpoints[eb.endpointIndex%len(endpoints)]
+}
+
+// Endpoint returns the endpoint of the current or most recent connection, or
+// "" before the first.
+func (eb *Eventbus) Endpoint() string {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	return eb.endpoint
+}
+
+// RemoteAddr returns the network address of the server instance on the
+// current or most recent connection, which identifies the instance behind a
+// load balancer, or "" before the first connection.
+func (eb *Eventbus) RemoteAddr() string {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	return eb.remoteAddr
+}
+
+// dial opens a connection to endpoint with keep-alive handling installed.
+func (eb *Eventbus) dial(endpoint string) (*websocket.Conn, error) {
+	eb.dialledAt = eb.clock.Now()
+	c, resp, err := eb.proxiedDialer().Dial(endpoint, nil)
+	if resp != nil {
+		eb.mu.Lock()
+		eb.handshakeResponse = resp.Header.Clone()
+		eb.mu.Unlock()
 	}
-	time.Sleep(reconnectTimeout)
-	c, _, err := eb.dialer.Dial(eb.config.Endpoint, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	c.SetReadDeadline(time.Now().Add(eb.KeepAliveTimeout))
+	keepAlive := eb.KeepAliveTimeout
+	c.SetReadDeadline(time.Now().Add(keepAlive))
 	pingHandler := c.PingHandler()
 	c.SetPingHandler(func(s string) error {
-		c.SetReadDeadline(time.Now().Add(eb.KeepAliveTimeout))
+		c.SetReadDeadline(time.Now().Add(keepAlive))
+		if eb.pingHandler != nil {
+			return eb.pingHandler(s)
+		}
 		pingHandler(s)
 		return nil
 	})
-	eb.socket = c
-	return nil
+	pongHandler := c.PongHandler()
+	c.SetPongHandler(func(s string) error {
+		c.SetReadDeadline(time.Now().Add(keepAlive))
+		if eb.pongHandler != nil {
+			return eb.pongHandler(s)
+		}
+		return pongHandler(s)
+	})
+	return c, nil
+}
+
+func (eb *Eventbus) setSocket(s socketClient) {
+	eb.mu.Lock()
+	eb.socket = s
+	eb.mu.Unlock()
+}
+
+func (eb *Eventbus) currentSocket() socketClient {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	return eb.socket
+}
+
+// SetPingHandler replaces the handler for pings received from the server.
+// The read deadline is extended before h is called. The default replies with a
+// pong carrying the same payload; a custom handler that wants to reply should
+// call Pong.
+func (eb *Eventbus) SetPingHandler(h func(appData string) error) {
+	eb.pingHandler = h
+}
+
+// SetPongHandler sets a handler for pongs received in reply to Ping.
+// The read deadline is extended before h is called.
+func (eb *Eventbus) SetPongHandler(h func(appData string) error) {
+	eb.pongHandler = h
+}
+
+// Ping sends a ping control frame with the payload to the server.
+func (eb *Eventbus) Ping(appData string) error {
+	return eb.writeControl(websocket.PingMessage, appData)
+}
+
+// Pong sends a pong control frame with the payload to the server.
+func (eb *Eventbus) Pong(appData string) error {
+	return eb.writeControl(websocket.PongMessage, appData)
+}
+
+func (eb *Eventbus) writeControl(messageType int, appData string) error {
+	s := eb.currentSocket()
+	if s == nil {
+		return ErrNotConnected
+	}
+	return s.WriteControl(messageType, []byte(appData), time.Now().Add(controlWriteTimeout))
 }
 
 // Run starts the eventbus loop.
@@ -85,108 +462,646 @@ func (eb *Eventbus) connect() error {
 // message in the stream.
 // It returns a chan that the caller can wait on to receive errors during event
 // streaming.
+// Only the first call starts the loop, later calls return the same chan.
+// The loop runs until it fails or Stop or Drain is called. Failed dials,
+// including the first, are logged and retried as the reconnection scheduler
+// directs, so the loop only fails for want of a connection once the scheduler
+// gives up, sending its error, such as ErrReconnectsExhausted, on the chan.
 func (eb *Eventbus) Run() chan error {
-	done := make(chan error)
+	eb.runOnce.Do(func() {
+		done := eb.begin()
+		go func() {
+			defer close(done)
+			err := eb.run()
+			eb.exit(err)
+			if err != nil {
+				done <- err
+			}
+		}()
+	})
+	return eb.done
+}
 
+// RunBlocking runs the eventbus loop on the calling goroutine until it fails,
+// returning the terminal error, or until ctx is done or Stop or Drain is
+// called, returning nil. Cancelling ctx stops the loop as Stop does: pending
+// offsets are flushed and the offset store is closed if it implements
+// io.Closer, and any error doing so is returned. Failed dials are retried as
+// for Run, until the reconnection scheduler gives up.
+// It returns ErrAlreadyRunning if Run or RunBlocking has already been called.
+func (eb *Eventbus) RunBlocking(ctx context.Context) error {
+	var done chan error
+	eb.runOnce.Do(func() {
+		done = eb.begin()
+	})
+	if done == nil {
+		return ErrAlreadyRunning
+	}
+	defer close(done)
+
+	returned := make(chan struct{})
+	defer close(returned)
 	go func() {
-		defer close(done)
-		defer func() {
-			if x := recover(); x != nil {
-				err, ok := x.(error)
-				if !ok {
-					err = fmt.Errorf("%q", err)
-				}
-				done <- err
+		select {
+		case <-ctx.Done():
+			eb.requestStop(false)
+		case <-returned:
+		}
+	}()
+	err := eb.run()
+	eb.exit(err)
+	if ctx.Err() != nil {
+		if serr := eb.awaitStop(); err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// begin marks the Eventbus as started and creates the chan returned by Run.
+func (eb *Eventbus) begin() chan error {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	eb.started = true
+	eb.done = make(chan error)
+	return eb.done
+}
+
+func (eb *Eventbus) run() (err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			if eb.panicHandler != nil {
+				eb.panicHandler(x, debug.Stack())
 			}
-			if eb.socket != nil {
-				eb.socket.Close()
+			panicErr, ok := x.(error)
+			if !ok {
+				panicErr = fmt.Errorf("panic in run loop: %v", x)
 			}
-		}()
-		for {
-			if eb.socket == nil {
-				err := eb.connect()
-				if err != nil {
-					done <- err
-					return
-				}
+			err = panicErr
+			if m := eb.inFlight; m != nil {
+				eb.notCommitted(m.Partition, m.Offset, HandlerPanicked, err)
 			}
-			_, msg, err := eb.socket.ReadMessage()
-			if err != nil {
-				eb.errorLogger(err)
-				eb.socket.Close()
-				eb.socket = nil
-				continue
+		}
+		if err := eb.flushOffsets(); err != nil {
+			eb.logError(err)
+		}
+		eb.stopHeartbeat()
+		eb.stopRotation()
+		eb.stopWatchdog()
+		if eb.socket != nil {
+			eb.socket.Close()
+		}
+		eb.stopReader()
+		eb.setState(nil)
+	}()
+	defer eb.startFlushTicker()()
+	defer eb.startCommitter()()
+	for {
+		eb.applyPendingOptions()
+		if stopping, draining := eb.stopState(); stopping && !draining {
+			return nil
+		}
+		if eb.socket == nil {
+			err := eb.connect()
+			if stopping, _ := eb.stopState(); stopping {
+				return nil
 			}
-			err = eb.state.handleEvent(eb, msg)
 			if err != nil {
-				eb.errorLogger(err)
-				eb.socket.Close()
-				eb.socket = nil
+				return err
+			}
+			eb.startReader(eb.socket)
+		}
+		eb.pauseForCircuit()
+		msg, err := eb.readFrame()
+		if err != nil {
+			if stopping, _ := eb.stopState(); stopping {
+				return nil
+			}
+			if eb.plannedReconnect() {
 				continue
 			}
+			if terminal := eb.terminalClose(err); terminal != nil {
+				return terminal
+			}
+			eb.recycle(err)
+			continue
 		}
-	}()
-	return done
+		if len(bytes.TrimSpace(msg)) == 0 {
+			eb.debugf("skipping empty frame in state %s", eb.state)
+			continue
+		}
+		eb.recordFrame(false, msg)
+		err = eb.state.handleEvent(eb, msg)
+		if me, ok := asMessageError(err); ok {
+			err = eb.skipMessage(me, err)
+		}
+		if limit, ok := asHandlerErrorLimit(err); ok {
+			return limit
+		}
+		if eb.retryHandshake(err) {
+			continue
+		}
+		if err != nil {
+			eb.recycle(err)
+			continue
+		}
+	}
+}
+
+// exit records the terminal error from the run loop and releases anything
+// waiting on the Eventbus.
+func (eb *Eventbus) exit(err error) {
+	eb.mu.Lock()
+	eb.exitErr = err
+	eb.mu.Unlock()
+	close(eb.exited)
+}
+
+// WaitReady blocks until the client has connected and reached the streaming
+// state for the first time, the context is done, or the run loop exits.
+// If the run loop exited it returns the terminal error, or ErrStopped.
+func (eb *Eventbus) WaitReady(ctx context.Context) error {
+	select {
+	case <-eb.ready:
+		return nil
+	case <-eb.exited:
+		eb.mu.Lock()
+		defer eb.mu.Unlock()
+		if eb.exitErr != nil {
+			return eb.exitErr
+		}
+		return ErrStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// recycle logs err and drops the current connection so that the run loop
+// reconnects.
+func (eb *Eventbus) recycle(err error) {
+	eb.logError(err)
+	eb.disconnect()
+	eb.mu.Lock()
+	eb.consecutiveFailures++
+	eb.mu.Unlock()
+}
+
+// disconnect flushes offsets and drops the current connection.
+func (eb *Eventbus) disconnect() {
+	if err := eb.flushOffsets(); err != nil {
+		eb.logError(err)
+	}
+	eb.stopHeartbeat()
+	eb.stopRotation()
+	eb.stopWatchdog()
+	eb.socket.Close()
+	eb.stopReader()
+	eb.setSocket(nil)
+	eb.setState(nil)
+}
+
+// Resubscribe makes the client handshake again, for example to pick up an
+// offset set with StartNextAt. The consumer protocol only allows one
+// handshake per connection, so this is a planned reconnect: pending offsets
+// are flushed, the connection is closed and a new one is made straight away,
+// with the reconnection backoff reset. It is not counted as a failure.
+// Frames read ahead with SetPrefetch but not yet handled are delivered again.
+func (eb *Eventbus) Resubscribe() {
+	eb.requestReconnect()
+}
+
+// requestReconnect closes the connection so that the run loop makes a new
+// one, without treating the close as an error.
+func (eb *Eventbus) requestReconnect() {
+	eb.mu.Lock()
+	socket := eb.socket
+	eb.reconnectRequested = socket != nil
+	eb.mu.Unlock()
+	if socket != nil {
+		socket.Close()
+	}
+}
+
+// plannedReconnect reports whether the connection was closed by
+// requestReconnect, and if so drops it ready for the next.
+func (eb *Eventbus) plannedReconnect() bool {
+	eb.mu.Lock()
+	planned := eb.reconnectRequested
+	eb.reconnectRequested = false
+	eb.mu.Unlock()
+	if !planned {
+		return false
+	}
+	eb.disconnect()
+	if r, ok := eb.Reconnection.(ResettableScheduler); ok {
+		r.Reset()
+	}
+	return true
+}
+
+// SetOnConnect sets a function called each time a connection has completed
+// its handshake, before any of its messages are handled, to warm up the
+// handler's dependencies such as refreshing a cache or reconnecting to a
+// downstream service. It is called on every connection, the first included,
+// so one-time setup belongs before Run instead. If it returns an error the
+// error is logged and the connection recycled, as for any other connection
+// failure, and it is called again on the next connection.
+func (eb *Eventbus) SetOnConnect(f func() error) {
+	eb.onConnect = f
+}
+
+func (eb *Eventbus) callOnConnect() error {
+	if eb.onConnect == nil {
+		return nil
+	}
+	return eb.onConnect()
+}
+
+// startStreaming is called when the server signals that messages will follow
+// the handshake.
+func (eb *Eventbus) startStreaming() {
+	eb.setState(streaming{})
+	eb.deliveredOffsets = nil
+	eb.mu.Lock()
+	eb.consecutiveFailures = 0
+	eb.mu.Unlock()
+	if r, ok := eb.Reconnection.(ResettableScheduler); ok {
+		r.Reset()
+	}
+	eb.startHeartbeat()
+	eb.startWatchdog()
+	eb.readyOnce.Do(func() { close(eb.ready) })
+}
+
+// SeenBefore reports whether a message at or beyond m's offset has already
+// been handled successfully for its partition, which happens when messages are
+// redelivered after a reconnect. Handlers with expensive side effects can use it
+// to skip duplicate work. Offsets are only tracked for the life of the
+// Eventbus and are forgotten when it is reset.
+func (eb *Eventbus) SeenBefore(m Message) bool {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	handled, ok := eb.handledOffsets[m.Partition]
+	return ok && m.Offset <= handled
+}
+
+func (eb *Eventbus) markHandled(m Message) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	if eb.handledOffsets == nil {
+		eb.handledOffsets = make(PartitionOffsets)
+	}
+	if handled, ok := eb.handledOffsets[m.Partition]; !ok || m.Offset > handled {
+		eb.handledOffsets[m.Partition] = m.Offset
+	}
+}
+
+// StoredOffsets returns a copy of the offsets committed to the offset store,
+// or nil if none have been, for use by admin tools. Batched offsets that have not
+// yet been flushed are not included.
+func (eb *Eventbus) StoredOffsets() (PartitionOffsets, error) {
+	offsets, err := eb.store.GetOffsets()
+	if err != nil || offsets == nil {
+		return nil, err
+	}
+	return offsets.copy(), nil
+}
+
+// LastHandshakeResponse returns the headers of the HTTP response to the most
+// recent websocket handshake, including failed ones, or nil before the first.
+func (eb *Eventbus) LastHandshakeResponse() http.Header {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	return eb.handshakeResponse.Clone()
+}
+
+// ServerVersion returns the version reported by the server in its handshake
+// on the current or most recent connection, or "" if it did not report one.
+func (eb *Eventbus) ServerVersion() string {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	return eb.serverVersion
+}
+
+// ServerSupports reports whether the server listed capability in its
+// handshake, so that options it would reject are only used when it supports
+// them. Servers that do not report capabilities support none.
+func (eb *Eventbus) ServerSupports(capability string) bool {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	return eb.serverCaps[capability]
+}
+
+func (eb *Eventbus) setServerInfo(version string, capabilities []string) {
+	caps := make(map[string]bool, len(capabilities))
+	for _, c := range capabilities {
+		caps[c] = true
+	}
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	eb.serverVersion = version
+	eb.serverCaps = caps
+}
+
+// ReconnectAttempts returns the number of times the client has reconnected
+// since Run was called, not counting the initial connection.
+func (eb *Eventbus) ReconnectAttempts() int {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	return eb.reconnects
+}
+
+// IsExhausted reports whether the reconnection scheduler has given up, as a
+// LimitedReconnectionPolicy does once its attempts are used, for supervisors
+// that poll rather than wait on Run. Once it reports true the run loop exits
+// and the scheduler's error, such as ErrReconnectsExhausted, is sent on the
+// chan returned by Run. The Eventbus cannot be run again, so a supervisor
+// replaces it with a new one to retry with a fresh policy.
+func (eb *Eventbus) IsExhausted() bool {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	return eb.exhausted
+}
+
+// ConsecutiveFailures returns the number of failed dials and connections
+// dropped because of an error since the client last reached the streaming
+// state.
+func (eb *Eventbus) ConsecutiveFailures() int {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	return eb.consecutiveFailures
+}
+
+// SetValidateBodies enables checking that each message carries a JSON body
+// before it is handled. Frames that are not valid JSON already fail to decode,
+// this additionally rejects messages whose body is missing or null. A message
+// that fails validation is skipped with a MessageError wrapping
+// ErrInvalidBody. Validation is off by default.
+func (eb *Eventbus) SetValidateBodies(validate bool) {
+	eb.validateBodies = validate
+}
+
+// An Unmarshaler decodes JSON with the semantics of json.Unmarshal.
+type Unmarshaler func(data []byte, v interface{}) error
+
+// SetUnmarshaler replaces json.Unmarshal for decoding message frames, the
+// hot path of the run loop, so a faster JSON library can be used at high
+// throughput. It must support json.RawMessage, and may leave a raw message
+// sharing the frame it decodes. A nil u restores json.Unmarshal, the default.
+func (eb *Eventbus) SetUnmarshaler(u Unmarshaler) {
+	eb.customUnmarshal = u != nil
+	if u == nil {
+		u = json.Unmarshal
+	}
+	eb.unmarshal = u
+}
+
+// SetMetaFilter sets a filter that is applied to the partition, offset and
+// stream of each message before the body is decoded, so that messages a
+// consumer is not interested in are never held in memory. Messages the filter
+// rejects are not passed to the EventHandler, but their offsets are committed.
+func (eb *Eventbus) SetMetaFilter(filter func(partition int32, offset int64, stream string) bool) {
+	eb.metaFilter = filter
+}
+
+// SetPartitionAllowlist restricts the client to messages from the partitions.
+// Messages from other partitions are skipped without being handled or
+// committed, leaving them to the consumer that owns them. The protocol has no
+// way to ask the server for a subset of partitions, so every partition is still
+// received. A nil or empty allowlist, the default, accepts all partitions.
+func (eb *Eventbus) SetPartitionAllowlist(partitions []int32) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	if len(partitions) == 0 {
+		eb.allowedPartitions = nil
+		return
+	}
+	eb.allowedPartitions = make(map[int32]bool, len(partitions))
+	for _, p := range partitions {
+		eb.allowedPartitions[p] = true
+	}
+}
+
+// SetTargetedOffsetReads makes the handshake read only the offsets of the
+// partitions in the allowlist, see SetPartitionAllowlist, rather than every
+// stored offset, which saves reading offsets the client does not need on
+// streams with many partitions. It needs a store that can read selected
+// partitions, such as the RedisOffsetStore, and has no effect otherwise or
+// without an allowlist. Offsets of other partitions are then left out of the
+// handshake and the server chooses where they start, although their messages
+// are skipped anyway. It is off by default.
+func (eb *Eventbus) SetTargetedOffsetReads(enabled bool) {
+	eb.targetedReads = enabled
+}
+
+// handshakeOffsets reads the offsets to resume from, only for the allowed
+// partitions if targeted reads are enabled.
+func (eb *Eventbus) handshakeOffsets() (*PartitionOffsets, error) {
+	getter, ok := eb.store.(partitionOffsetGetter)
+	if !eb.targetedReads || !ok {
+		return eb.store.GetOffsets()
+	}
+	eb.mu.Lock()
+	partitions := make([]int32, 0, len(eb.allowedPartitions))
+	for p := range eb.allowedPartitions {
+		partitions = append(partitions, p)
+	}
+	eb.mu.Unlock()
+	if len(partitions) == 0 {
+		return eb.store.GetOffsets()
+	}
+	return getter.GetPartitionOffsets(partitions)
+}
+
+func (eb *Eventbus) hasPartitionAllowlist() bool {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	return eb.allowedPartitions != nil
+}
+
+func (eb *Eventbus) partitionAllowed(partition int32) bool {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	return eb.allowedPartitions == nil || eb.allowedPartitions[partition]
+}
+
+// SetClock replaces the clock used to wait between reconnection attempts.
+func (eb *Eventbus) SetClock(c Clock) {
+	eb.clock = c
+}
+
+// SetDialer replaces the websocket dialer used to connect to eventbus-sub.
+func (eb *Eventbus) SetDialer(d Dialer) {
+	eb.dialer = d
+}
+
+// SetOffsetEncoder replaces the encoding of the handshake state, for servers
+// that expect a different format.
+func (eb *Eventbus) SetOffsetEncoder(e OffsetEncoder) {
+	eb.offsetEncoder = e
+}
+
+// SetProxy sets the function returning the proxy to connect through, as with
+// http.Transport. The URL may carry credentials for proxy authentication.
+// The proxy is applied on every connection attempt when the dialer is a
+// *websocket.Dialer, as it is by default; a custom Dialer is responsible for its
+// own proxying.
+func (eb *Eventbus) SetProxy(proxy func(*http.Request) (*url.URL, error)) {
+	eb.proxy = proxy
+}
+
+func (eb *Eventbus) proxiedDialer() Dialer {
+	d, ok := eb.dialer.(*websocket.Dialer)
+	if eb.proxy == nil || !ok {
+		return eb.dialer
+	}
+	proxied := *d
+	proxied.Proxy = eb.proxy
+	return &proxied
 }
 
 // SetErrorLogger allows configuration of the error logging mechanism.
+// A nil logger discards errors.
 func (eb *Eventbus) SetErrorLogger(el func(e error)) {
+	if el == nil {
+		el = func(error) {}
+	}
+	eb.logMu.Lock()
 	eb.errorLogger = el
+	eb.logMu.Unlock()
+}
+
+// SetPanicHandler sets a function called with the recovered value and stack
+// trace when a panic, such as one in a handler, stops the run loop, to report
+// crashes before the loop exits. The panic is still returned on the chan
+// returned by Run, as an error.
+func (eb *Eventbus) SetPanicHandler(h func(recovered interface{}, stack []byte)) {
+	eb.panicHandler = h
 }
 
 // TODO: this should probably verify that the fields are present.
-func (eb Eventbus) createHandshake(serverID string) map[string]string {
+func (eb *Eventbus) createHandshake(serverID string) (map[string]string, error) {
+	token, err := eb.config.authToken()
+	if err != nil {
+		return nil, err
+	}
 	handshake := map[string]string{
 		"id":             serverID,
-		"authentication": eb.config.AuthToken,
+		"authentication": token,
 		"stream":         eb.config.Stream,
 		"client":         eb.config.Client,
 		"version":        eb.config.Version,
 	}
-	offsets, err := eb.store.GetOffsets()
-	if err == nil {
-		if offsets == nil {
-			handshake["state"] = encodeStarting(eb.startingOffset)
-		} else {
-			handshake["state"] = encodeOffsets(*offsets)
+	if eb.config.ConsumerGroup != "" {
+		handshake["group"] = eb.config.ConsumerGroup
+	}
+	eb.mu.Lock()
+	startingOffset := eb.startingOffset
+	next := eb.nextStart
+	eb.nextStart = nil
+	eb.mu.Unlock()
+	if next != nil {
+		state, err := eb.offsetEncoder.EncodeStarting(*next)
+		if err != nil {
+			return nil, err
+		}
+		handshake["state"] = state
+		eb.recordHandshakeState(&HandshakeState{Starting: *next, Encoded: state})
+		return handshake, nil
+	}
+	offsets, err := eb.handshakeOffsets()
+	if err != nil {
+		eb.recordHandshakeState(nil)
+		return handshake, nil
+	}
+	var sent HandshakeState
+	if offsets == nil {
+		sent.Starting = startingOffset
+		sent.Encoded, err = eb.offsetEncoder.EncodeStarting(startingOffset)
+	} else {
+		sent.Offsets = eb.fillMissing(*offsets, startingOffset)
+		sent.Encoded, err = eb.offsetEncoder.EncodeOffsets(sent.Offsets)
+	}
+	if err != nil {
+		return nil, err
+	}
+	handshake["state"] = sent.Encoded
+	eb.recordHandshakeState(&sent)
+	return handshake, nil
+}
+
+// SetFillMissingPartitions controls where partitions without a committed
+// offset start once some other partition has one. By default only committed
+// partitions are sent in the handshake and the server chooses where the rest
+// start. With fill set, each of partitions that has no committed offset is
+// sent with the starting offset, OffsetOldest unless StartAtNewest was called.
+// Until any offset is committed the starting offset applies to every
+// partition either way.
+func (eb *Eventbus) SetFillMissingPartitions(partitions []int32) {
+	eb.fillPartitions = append([]int32(nil), partitions...)
+}
+
+// fillMissing returns offsets with the starting offset added for each
+// partition set with SetFillMissingPartitions that has none.
+func (eb *Eventbus) fillMissing(offsets PartitionOffsets, startingOffset int64) PartitionOffsets {
+	if len(eb.fillPartitions) == 0 {
+		return offsets
+	}
+	filled := offsets.copy()
+	for _, p := range eb.fillPartitions {
+		if _, ok := filled[p]; !ok {
+			filled[p] = startingOffset
 		}
 	}
-	return handshake
+	return filled
+}
+
+// handshakeBytes returns the handshake sent in reply to the server greeting
+// with serverID. It is a JSON object of strings with sorted keys:
+//
+//	{"authentication":"<token>","client":"<client>","id":"<server id>",
+//	 "state":"<resume position>","stream":"<stream>","version":"<version>"}
+//
+// A "group" key is added when Config.ConsumerGroup is set.
+//
+// With the DefaultOffsetEncoder state is base64 of {"d":"-2"} when no offsets
+// have been committed, or of {"p":{"0":"42"}} with the committed offset for
+// each partition. state is left out if the offsets could not be read.
+func (eb *Eventbus) handshakeBytes(serverID string) ([]byte, error) {
+	handshake, err := eb.createHandshake(serverID)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(handshake)
 }
 
 // NewEventbus creates a new Eventbus client to handle events.
-func NewEventbus(config Config, handler EventHandler, store offsetStore) *Eventbus {
-	return &Eventbus{
+func NewEventbus(config Config, handler EventHandler, store offsetStore, opts ...Option) *Eventbus {
+	eb := &Eventbus{
 		config:           config,
 		eventHandler:     handler,
 		store:            store,
 		dialer:           websocket.DefaultDialer,
+		clock:            realClock{},
+		offsetEncoder:    DefaultOffsetEncoder{},
+		metrics:          noopMetrics{},
 		startingOffset:   OffsetOldest,
 		Reconnection:     DefaultPolicy.NewScheduler(),
 		KeepAliveTimeout: DefaultKeepAliveTimeout,
+		unmarshal:        json.Unmarshal,
+		stats:            &connStats{},
+		ready:            make(chan struct{}),
+		exited:           make(chan struct{}),
+		stop:             make(chan struct{}),
 		errorLogger: func(err error) {
 			log.Print(err.Error())
 		},
 	}
-}
-
-func encodeOffsets(offsets PartitionOffsets) string {
-	data := map[string]PartitionOffsets{"p": offsets}
-	encoded, err := json.Marshal(data)
-	if err != nil {
-		log.Panicf("unable to marshall partition offset data: %s", err)
+	eb.SetHandshakeRetries(1, 100*time.Millisecond)
+	for _, opt := range opts {
+		opt(eb)
 	}
-	return base64.StdEncoding.EncodeToString([]byte(encoded))
-}
-
-// Eventbus has an undocumented {"d": sarama offset} feature
-func encodeStarting(position int64) string {
-	data := map[string]string{"d": strconv.FormatInt(position, 10)}
-	encoded, err := json.Marshal(data)
-	if err != nil {
-		log.Panicf("unable to marshall partition offset data: %s", err)
-	}
-	return base64.StdEncoding.EncodeToString([]byte(encoded))
+	return eb
 }
 
 // Config records the fields that are use to identify the eventbus client to the
@@ -194,9 +1109,44 @@ func encodeStarting(position int64) string {
 type Config struct {
 	Endpoint  string
 	AuthToken string
-	Stream    string
-	Client    string
-	Version   string
+	// Stream names the single stream to consume, it is sent verbatim in the
+	// handshake. The consumer protocol has no notion of stream patterns, so a
+	// value such as "orders.*" is not expanded by the client; run an Eventbus
+	// per stream to follow several.
+	Stream  string
+	Client  string
+	Version string
+
+	// ConsumerGroup, when set, is sent in the handshake so that the server
+	// can balance partitions across the consumers in the group. Changes to
+	// the assigned partitions are reported to the callbacks set with
+	// SetOnPartitionsAssigned and SetOnPartitionsRevoked.
+	ConsumerGroup string
+
+	// AuthTokenFunc is called for a fresh token on every handshake, for
+	// credentials that expire and rotate. When set it takes precedence over
+	// AuthToken.
+	AuthTokenFunc func() (string, error)
+
+	// Endpoints are fallbacks, such as a secondary region, tried in turn
+	// after Endpoint when a dial fails. The client stays on whichever
+	// endpoint it last connected to until a dial to it fails.
+	Endpoints []string
+}
+
+func (c Config) authToken() (string, error) {
+	if c.AuthTokenFunc != nil {
+		return c.AuthTokenFunc()
+	}
+	return c.AuthToken, nil
+}
+
+// endpoints returns Endpoint followed by the fallback Endpoints.
+func (c Config) endpoints() []string {
+	if c.Endpoint == "" {
+		return c.Endpoints
+	}
+	return append([]string{c.Endpoint}, c.Endpoints...)
 }
 
 type messageWriter interface {
@@ -216,9 +1166,12 @@ type socketClient interface {
 	messageReader
 	messageCloser
 
+	WriteControl(int, []byte, time.Time) error
 	SetPingHandler(h func(appData string) error)
 }
 
-type dialer interface {
+// A Dialer opens the websocket connection to eventbus-sub,
+// *websocket.Dialer satisfies this interface.
+type Dialer interface {
 	Dial(string, http.Header) (*websocket.Conn, *http.Response, error)
 }
@@ -0,0 +1,116 @@
+package eventbus_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	eventbus "github.com/luzcn6/event-bus"
+	"github.com/luzcn6/event-bus/eventbustest"
+)
+
+func TestResetToOldestReconnects(t *testing.T) {
+	s := newSession(t, `{"offset":1,"partition":0,"body":{}}`)
+	h := &recorder{}
+	store := eventbus.NewInMemoryOffsetStore()
+	errs := make(chan error, 10)
+	eb := newEventbus(t, s.Endpoint(), h, store, eventbus.WithErrorChannel(errs))
+	run(t, eb)
+
+	s.handshake(t)
+	waitFor(t, "offset 1 to be committed", func() bool { return storedOffset(store, 0) == 1 })
+	if err := eb.ResetToOldest(); err != nil {
+		t.Fatalf("ResetToOldest() = %v", err)
+	}
+	s.handshake(t)
+	select {
+	case err := <-errs:
+		t.Errorf("logged %v, want the reset not treated as an error", err)
+	default:
+	}
+}
+
+func TestResetDuringBackoff(t *testing.T) {
+	var mu sync.Mutex
+	conns := 0
+	srv := eventbustest.NewServer(func(c *websocket.Conn) {
+		mu.Lock()
+		conns++
+		n := conns
+		mu.Unlock()
+		if err := c.WriteJSON(map[string]string{"id": "srv"}); err != nil {
+			return
+		}
+		var h map[string]string
+		if err := c.ReadJSON(&h); err != nil {
+			return
+		}
+		frames := []string{`{"status":"ok"}`, `{"offset":1,"partition":0,"body":{}}`}
+		if n > 1 {
+			frames = []string{`{"status":"ok"}`, `{"offset":5,"partition":0,"body":{}}`}
+		}
+		for _, f := range frames {
+			if err := c.WriteMessage(websocket.TextMessage, []byte(f)); err != nil {
+				return
+			}
+		}
+		if n == 1 {
+			// Drop the first connection, so the client waits to redial.
+			return
+		}
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	defer srv.Close()
+	clock := eventbustest.NewFakeClock(time.Unix(0, 0))
+	store := eventbus.NewInMemoryOffsetStore()
+	eb := newEventbus(t, srv.Endpoint(), &recorder{}, store, eventbus.WithFirstConnectImmediate(true))
+	eb.SetClock(clock)
+	eb.Reconnection = eventbus.NewConstantReconnectionPolicy(time.Second).NewScheduler()
+	run(t, eb)
+
+	waitFor(t, "offset 1 to be committed", func() bool { return storedOffset(store, 0) == 1 })
+	waitFor(t, "the redial backoff", func() bool {
+		d, ok := clock.NextWake()
+		return ok && d == time.Second
+	})
+	if err := eb.ResetToOldest(); err != nil {
+		t.Fatalf("ResetToOldest() = %v", err)
+	}
+	clock.Advance(time.Second)
+	waitFor(t, "offset 5 to be committed after the redial", func() bool { return storedOffset(store, 0) == 5 })
+}
+
+func TestRunTwice(t *testing.T) {
+	s := newSession(t)
+	eb := newEventbus(t, s.Endpoint(), &recorder{}, eventbus.NewInMemoryOffsetStore())
+
+	var wg sync.WaitGroup
+	dones := make([]<-chan error, 2)
+	for i := range dones {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dones[i] = run(t, eb)
+		}(i)
+	}
+	wg.Wait()
+
+	if dones[0] != dones[1] {
+		t.Error("the second Run returned a different chan, want the running loop's")
+	}
+	if err := eb.RunBlocking(context.Background()); err != eventbus.ErrAlreadyRunning {
+		t.Errorf("RunBlocking() = %v, want ErrAlreadyRunning", err)
+	}
+	s.handshake(t)
+	select {
+	case <-s.handshakes:
+		t.Error("a second loop connected")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
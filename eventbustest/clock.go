@@ -0,0 +1,116 @@
+package eventbustest
+
+import (
+	"sync"
+	"time"
+)
+
+// FakeClock is an eventbus.Clock that only moves when Advance is called.
+type FakeClock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*waiter
+}
+
+type waiter struct {
+	until time.Time
+	c     chan time.Time
+}
+
+// NewFakeClock creates a new FakeClock starting at t.
+func NewFakeClock(t time.Time) *FakeClock {
+	c := &FakeClock{now: t}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the current fake time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns a channel that receives the fake time once the clock has been
+// advanced by at least d.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, &waiter{until: c.now.Add(d), c: ch})
+	c.cond.Broadcast()
+	return ch
+}
+
+// Advance moves the clock forward by d and fires any timers that have expired.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	var pending []*waiter
+	for _, w := range c.waiters {
+		if w.until.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.c <- c.now
+	}
+	c.waiters = pending
+	c.cond.Broadcast()
+}
+
+// BlockUntil blocks until at least n timers are waiting on the clock.
+func (c *FakeClock) BlockUntil(n int) {
+	c.blockUntil(n, nil)
+}
+
+// blockUntil is BlockUntil, giving up and returning false once quit is
+// closed.
+func (c *FakeClock) blockUntil(n int, quit <-chan struct{}) bool {
+	if quit != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-quit:
+				c.mu.Lock()
+				c.cond.Broadcast()
+				c.mu.Unlock()
+			case <-done:
+			}
+		}()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.waiters) < n {
+		select {
+		case <-quit:
+			return false
+		default:
+		}
+		c.cond.Wait()
+	}
+	return true
+}
+
+// NextWake returns the time until the earliest pending timer fires, and false
+// if there are no pending timers.
+func (c *FakeClock) NextWake() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.waiters) == 0 {
+		return 0, false
+	}
+	next := c.waiters[0].until
+	for _, w := range c.waiters[1:] {
+		if w.until.Before(next) {
+			next = w.until
+		}
+	}
+	return next.Sub(c.now), true
+}
@@ -0,0 +1,56 @@
+package eventbustest
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrDialFailed is returned by a FailingDialer with no Err set.
+var ErrDialFailed = errors.New("dial failed")
+
+// FailingDialer is an eventbus.Dialer whose every dial fails, for testing how
+// an Eventbus behaves when eventbus-sub is unreachable. Combined with a
+// FakeClock and a limited reconnection policy it lets a test drive the client
+// to ErrReconnectsExhausted without waiting out real backoffs:
+//
+//	clock := eventbustest.NewFakeClock(time.Now())
+//	dialer := &eventbustest.FailingDialer{}
+//	eb.SetClock(clock)
+//	eb.SetDialer(dialer)
+//	eb.Reconnection = eventbus.NewLimitedReconnectionPolicy(3, time.Second).NewScheduler()
+//	done := eb.Run()
+//	for i := 0; i < 3; i++ {
+//		clock.BlockUntil(1)
+//		clock.Advance(time.Second)
+//	}
+//	err := <-done // eventbus.ErrReconnectsExhausted, after 3 dials
+//
+// It is safe for concurrent use.
+type FailingDialer struct {
+	// Err is returned from every dial, ErrDialFailed if nil.
+	Err error
+
+	mu    sync.Mutex
+	dials int
+}
+
+// Dial implements eventbus.Dialer, counting the attempt and failing it.
+func (d *FailingDialer) Dial(string, http.Header) (*websocket.Conn, *http.Response, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials++
+	if d.Err == nil {
+		return nil, nil, ErrDialFailed
+	}
+	return nil, nil, d.Err
+}
+
+// Dials returns the number of dial attempts made.
+func (d *FailingDialer) Dials() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials
+}
@@ -0,0 +1,143 @@
+package eventbustest
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	eventbus "github.com/luzcn6/event-bus"
+)
+
+// StepTimeout is the real time a ReconnectHarness waits for the run loop
+// before giving up on a step.
+var StepTimeout = 5 * time.Second
+
+var (
+	// ErrStepTimeout is returned when the run loop did not reach the next
+	// reconnect within StepTimeout.
+	ErrStepTimeout = errors.New("timed out waiting for reconnect")
+	// ErrStopped is returned when the run loop exited without an error, it is
+	// eventbus.ErrStopped.
+	ErrStopped = eventbus.ErrStopped
+)
+
+// ReconnectHarness runs an Eventbus against a Server that drops every
+// connection, so each pass around the run loop is a reconnect. Time is driven
+// by a FakeClock so tests can assert the delays between dial attempts without
+// sleeping.
+type ReconnectHarness struct {
+	Clock    *FakeClock
+	Eventbus *eventbus.Eventbus
+
+	server   *Server
+	dials    chan time.Time
+	done     chan error
+	started  time.Time
+	attempts []time.Time
+}
+
+// NewReconnectHarness creates a ReconnectHarness whose Eventbus uses a
+// scheduler from policy.
+func NewReconnectHarness(policy eventbus.ReconnectionPolicy) *ReconnectHarness {
+	h := &ReconnectHarness{
+		Clock:  NewFakeClock(time.Unix(0, 0)),
+		server: NewServer(nil),
+		dials:  make(chan time.Time, 1),
+	}
+	eb := eventbus.NewEventbus(
+		eventbus.Config{Endpoint: h.server.Endpoint()},
+		eventbus.EventHandlerFunc(func(eventbus.Message) error { return nil }),
+		eventbus.NewInMemoryOffsetStore(),
+	)
+	eb.Reconnection = policy.NewScheduler()
+	eb.SetClock(h.Clock)
+	eb.SetDialer(&recordingDialer{clock: h.Clock, dialer: websocket.DefaultDialer, dials: h.dials})
+	eb.SetErrorLogger(func(error) {})
+	h.Eventbus = eb
+	return h
+}
+
+// Start runs the Eventbus, the first dial happens on the first Step.
+func (h *ReconnectHarness) Start() {
+	h.started = h.Clock.Now()
+	h.done = h.Eventbus.Run()
+}
+
+// Step advances the clock to the next reconnection backoff and waits for the
+// dial attempt that follows it, returning the delay since the previous attempt.
+// If the run loop exits instead, its terminal error is returned.
+func (h *ReconnectHarness) Step() (time.Duration, error) {
+	wake := make(chan time.Duration, 1)
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		if !h.Clock.blockUntil(1, quit) {
+			return
+		}
+		d, _ := h.Clock.NextWake()
+		wake <- d
+	}()
+	select {
+	case d := <-wake:
+		h.Clock.Advance(d)
+	case err := <-h.done:
+		return 0, stopped(err)
+	case <-time.After(StepTimeout):
+		return 0, ErrStepTimeout
+	}
+
+	select {
+	case t := <-h.dials:
+		previous := h.started
+		if len(h.attempts) > 0 {
+			previous = h.attempts[len(h.attempts)-1]
+		}
+		h.attempts = append(h.attempts, t)
+		return t.Sub(previous), nil
+	case err := <-h.done:
+		return 0, stopped(err)
+	case <-time.After(StepTimeout):
+		return 0, ErrStepTimeout
+	}
+}
+
+// Attempts returns the fake times of the dial attempts seen so far.
+func (h *ReconnectHarness) Attempts() []time.Time {
+	return append([]time.Time(nil), h.attempts...)
+}
+
+// Delays returns the delays between consecutive dial attempts, starting with
+// the delay between Start and the first attempt.
+func (h *ReconnectHarness) Delays() []time.Duration {
+	var delays []time.Duration
+	previous := h.started
+	for _, t := range h.attempts {
+		delays = append(delays, t.Sub(previous))
+		previous = t
+	}
+	return delays
+}
+
+// Close shuts down the server backing the harness.
+func (h *ReconnectHarness) Close() {
+	h.server.Close()
+}
+
+func stopped(err error) error {
+	if err == nil {
+		return ErrStopped
+	}
+	return err
+}
+
+type recordingDialer struct {
+	clock  *FakeClock
+	dialer eventbus.Dialer
+	dials  chan time.Time
+}
+
+func (d *recordingDialer) Dial(url string, h http.Header) (*websocket.Conn, *http.Response, error) {
+	d.dials <- d.clock.Now()
+	return d.dialer.Dial(url, h)
+}
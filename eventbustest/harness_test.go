@@ -0,0 +1,96 @@
+package eventbustest
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	eventbus "github.com/luzcn6/event-bus"
+)
+
+func TestReconnectHarnessDelays(t *testing.T) {
+	h := NewReconnectHarness(eventbus.NewExponentialReconnectionPolicy(time.Second, 4*time.Second))
+	defer h.Close()
+	h.Start()
+	defer h.Eventbus.Stop()
+
+	for i := 0; i < 4; i++ {
+		if _, err := h.Step(); err != nil {
+			t.Fatalf("Step() = %v", err)
+		}
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}
+	if got := h.Delays(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Delays() = %v, want %v", got, want)
+	}
+	if n := len(h.Attempts()); n != 4 {
+		t.Errorf("len(Attempts()) = %d, want 4", n)
+	}
+}
+
+func TestReconnectHarnessStopped(t *testing.T) {
+	h := NewReconnectHarness(eventbus.NewConstantReconnectionPolicy(time.Second))
+	defer h.Close()
+	h.Start()
+	if _, err := h.Step(); err != nil {
+		t.Fatalf("Step() = %v", err)
+	}
+	h.Eventbus.Stop()
+
+	if _, err := h.Step(); err != ErrStopped {
+		t.Errorf("Step() after Stop = %v, want ErrStopped", err)
+	}
+	if ErrStopped != eventbus.ErrStopped {
+		t.Error("ErrStopped is not eventbus.ErrStopped")
+	}
+}
+
+func TestBlockUntilQuit(t *testing.T) {
+	c := NewFakeClock(time.Unix(0, 0))
+	before := runtime.NumGoroutine()
+	quit := make(chan struct{})
+	returned := make(chan bool)
+	go func() {
+		returned <- c.blockUntil(1, quit)
+	}()
+	close(quit)
+	select {
+	case ok := <-returned:
+		if ok {
+			t.Error("blockUntil() = true with no timers, want false")
+		}
+	case <-time.After(StepTimeout):
+		t.Fatal("blockUntil did not return once quit was closed")
+	}
+	deadline := time.Now().Add(StepTimeout)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines left running, want %d", n, before)
+	}
+}
+
+func TestFakeClockAdvance(t *testing.T) {
+	c := NewFakeClock(time.Unix(0, 0))
+	fired := c.After(2 * time.Second)
+	if d, ok := c.NextWake(); !ok || d != 2*time.Second {
+		t.Fatalf("NextWake() = %v, %v, want 2s, true", d, ok)
+	}
+	c.Advance(time.Second)
+	select {
+	case <-fired:
+		t.Fatal("timer fired early")
+	default:
+	}
+	c.Advance(time.Second)
+	select {
+	case now := <-fired:
+		if !now.Equal(time.Unix(2, 0)) {
+			t.Errorf("timer fired at %v, want %v", now, time.Unix(2, 0))
+		}
+	default:
+		t.Fatal("timer did not fire")
+	}
+}
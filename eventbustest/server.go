@@ -0,0 +1,38 @@
+// Package eventbustest provides utilities for testing code built on the
+// eventbus client.
+package eventbustest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Server is a local websocket server standing in for eventbus-sub.
+type Server struct {
+	*httptest.Server
+}
+
+// NewServer starts a Server that upgrades every request and passes the
+// connection to handler, the connection is closed when handler returns.
+// A nil handler closes each connection immediately.
+func NewServer(handler func(*websocket.Conn)) *Server {
+	upgrader := websocket.Upgrader{}
+	return &Server{httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if handler != nil {
+			handler(c)
+		}
+	}))}
+}
+
+// Endpoint returns the ws:// URL to use as the eventbus Config.Endpoint.
+func (s *Server) Endpoint() string {
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
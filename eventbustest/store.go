@@ -0,0 +1,106 @@
+package eventbustest
+
+import (
+	"sync"
+
+	eventbus "github.com/luzcn6/event-bus"
+)
+
+// OffsetStore is the offset store interface accepted by eventbus.NewEventbus.
+type OffsetStore interface {
+	SetOffset(int32, int64) error
+	GetOffsets() (*eventbus.PartitionOffsets, error)
+}
+
+// FaultyOffsetStore wraps an OffsetStore and fails calls on demand, to test
+// how an Eventbus copes with store errors when committing or handshaking.
+// Calls that are not failed are passed to the wrapped store. Only SetOffset
+// and GetOffsets are wrapped, so commit metadata is not recorded and resets
+// are unsupported. It is safe for concurrent use.
+type FaultyOffsetStore struct {
+	Store OffsetStore
+
+	mu       sync.Mutex
+	setErr   error
+	setFails int
+	getErr   error
+	getFails int
+	sets     int
+	gets     int
+}
+
+// NewFaultyOffsetStore creates a FaultyOffsetStore wrapping store that does
+// not fail until told to.
+func NewFaultyOffsetStore(store OffsetStore) *FaultyOffsetStore {
+	return &FaultyOffsetStore{Store: store}
+}
+
+// FailSetOffset makes the next n calls to SetOffset return err without
+// reaching the wrapped store. A negative n fails every call until
+// FailSetOffset is called again, a zero n stops failing.
+func (s *FaultyOffsetStore) FailSetOffset(err error, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setErr = err
+	s.setFails = n
+}
+
+// FailGetOffsets makes the next n calls to GetOffsets return err, as
+// FailSetOffset does for SetOffset.
+func (s *FaultyOffsetStore) FailGetOffsets(err error, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.getErr = err
+	s.getFails = n
+}
+
+// SetOffset implements the offset store, failing if told to.
+func (s *FaultyOffsetStore) SetOffset(partition int32, offset int64) error {
+	s.mu.Lock()
+	s.sets++
+	err := fault(s.setErr, &s.setFails)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.Store.SetOffset(partition, offset)
+}
+
+// GetOffsets implements the offset store, failing if told to.
+func (s *FaultyOffsetStore) GetOffsets() (*eventbus.PartitionOffsets, error) {
+	s.mu.Lock()
+	s.gets++
+	err := fault(s.getErr, &s.getFails)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return s.Store.GetOffsets()
+}
+
+// SetOffsetCalls returns the number of calls to SetOffset, including failed
+// ones.
+func (s *FaultyOffsetStore) SetOffsetCalls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sets
+}
+
+// GetOffsetsCalls returns the number of calls to GetOffsets, including failed
+// ones.
+func (s *FaultyOffsetStore) GetOffsetsCalls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gets
+}
+
+// fault returns err if a failure is due, counting it against remaining.
+func fault(err error, remaining *int) error {
+	if *remaining == 0 {
+		return nil
+	}
+	if *remaining > 0 {
+		*remaining--
+	}
+	return err
+}
@@ -0,0 +1,100 @@
+package eventbus
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// FrameKeys names the JSON fields of the frames sent by eventbus-sub, so the
+// client can be pointed at server versions that use different names. An empty
+// field keeps the default name.
+type FrameKeys struct {
+	ID        string
+	Status    string
+	Stream    string
+	Offset    string
+	Partition string
+	Body      string
+	Headers   string
+}
+
+// DefaultFrameKeys are the field names used by the consumer protocol.
+var DefaultFrameKeys = FrameKeys{
+	ID:        "id",
+	Status:    "status",
+	Stream:    "stream",
+	Offset:    "offset",
+	Partition: "partition",
+	Body:      "body",
+	Headers:   "headers",
+}
+
+// WithFrameKeys decodes frames using the field names in keys.
+func WithFrameKeys(keys FrameKeys) Option {
+	return func(eb *Eventbus) {
+		eb.frameAliases = keys.aliases()
+	}
+}
+
+// aliases maps each non-default field name to its default.
+func (k FrameKeys) aliases() map[string]string {
+	pairs := [][2]string{
+		{k.ID, DefaultFrameKeys.ID},
+		{k.Status, DefaultFrameKeys.Status},
+		{k.Stream, DefaultFrameKeys.Stream},
+		{k.Offset, DefaultFrameKeys.Offset},
+		{k.Partition, DefaultFrameKeys.Partition},
+		{k.Body, DefaultFrameKeys.Body},
+		{k.Headers, DefaultFrameKeys.Headers},
+	}
+	aliases := make(map[string]string)
+	for _, p := range pairs {
+		if p[0] != "" && p[0] != p[1] {
+			aliases[p[0]] = p[1]
+		}
+	}
+	if len(aliases) == 0 {
+		return nil
+	}
+	return aliases
+}
+
+// normalizeFrame renames the fields of a frame to the default names.
+// Frames that are not JSON objects, or arrays of them, are returned unchanged
+// for the state to report.
+func (eb *Eventbus) normalizeFrame(body []byte) []byte {
+	if eb.frameAliases == nil {
+		return body
+	}
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var frames []json.RawMessage
+		if err := json.Unmarshal(body, &frames); err != nil {
+			return body
+		}
+		for i, f := range frames {
+			frames[i] = eb.normalizeFrame(f)
+		}
+		normalized, err := json.Marshal(frames)
+		if err != nil {
+			return body
+		}
+		return normalized
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body
+	}
+	renamed := make(map[string]json.RawMessage, len(fields))
+	for name, value := range fields {
+		if alias, ok := eb.frameAliases[name]; ok {
+			name = alias
+		}
+		renamed[name] = value
+	}
+	normalized, err := json.Marshal(renamed)
+	if err != nil {
+		return body
+	}
+	return normalized
+}
@@ -0,0 +1,109 @@
+package eventbus_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	eventbus "github.com/luzcn6/event-bus"
+)
+
+func TestFrameKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     *eventbus.FrameKeys
+		greeting string
+		ready    string
+		message  string
+	}{
+		{
+			name:     "default",
+			greeting: `{"id":"srv"}`,
+			ready:    `{"status":"ok"}`,
+			message:  `{"offset":1,"partition":0,"body":{"n":1},"headers":{"trace":"t-1"}}`,
+		},
+		{
+			name: "renamed",
+			keys: &eventbus.FrameKeys{
+				ID:        "server_id",
+				Status:    "state",
+				Offset:    "seq",
+				Partition: "shard",
+				Body:      "payload",
+				Headers:   "meta",
+			},
+			greeting: `{"server_id":"srv"}`,
+			ready:    `{"state":"ok"}`,
+			message:  `{"seq":1,"shard":0,"payload":{"n":1},"meta":{"trace":"t-1"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newScriptedSession(t, tt.greeting, tt.ready, tt.message)
+			h := &recorder{}
+			store := eventbus.NewInMemoryOffsetStore()
+			var opts []eventbus.Option
+			if tt.keys != nil {
+				opts = append(opts, eventbus.WithFrameKeys(*tt.keys))
+			}
+			eb := newEventbus(t, s.Endpoint(), h, store, opts...)
+			run(t, eb)
+
+			if id := s.handshake(t)["id"]; id != "srv" {
+				t.Errorf("handshake id = %q, want srv", id)
+			}
+			waitFor(t, "offset 1 to be committed", func() bool { return storedOffset(store, 0) == 1 })
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			m := h.messages[0]
+			if string(m.Body) != `{"n":1}` || !reflect.DeepEqual(m.Headers, map[string]string{"trace": "t-1"}) {
+				t.Errorf("message = %+v, want body {\"n\":1} and the trace header", m)
+			}
+		})
+	}
+}
+
+// aliasingUnmarshal is json.Unmarshal, but leaves each json.RawMessage field
+// of v sharing data, as some faster JSON libraries do.
+func aliasingUnmarshal(data []byte, v interface{}) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	rv := reflect.ValueOf(v).Elem()
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Field(i)
+		raw, ok := field.Interface().(json.RawMessage)
+		if !ok || len(raw) == 0 {
+			continue
+		}
+		if j := bytes.Index(data, raw); j >= 0 {
+			field.Set(reflect.ValueOf(json.RawMessage(data[j : j+len(raw)])))
+		}
+	}
+	return nil
+}
+
+func TestLowAllocReadsWithAliasingUnmarshaler(t *testing.T) {
+	s := newSession(t,
+		`{"offset":1,"partition":0,"body":{"n":1}}`,
+		`{"offset":2,"partition":0,"body":{"n":2}}`,
+	)
+	h := &recorder{}
+	eb := newEventbus(t, s.Endpoint(), h, eventbus.NewInMemoryOffsetStore())
+	eb.SetUnmarshaler(aliasingUnmarshal)
+	eb.SetLowAllocReads(true)
+	run(t, eb)
+
+	waitFor(t, "both messages to be handled", func() bool { return len(h.offsets()) == 2 })
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, want := range []string{`{"n":1}`, `{"n":2}`} {
+		if got := string(h.messages[i].Body); got != want {
+			t.Errorf("body of message %d = %s, want %s", i+1, got, want)
+		}
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/luzcn6/event-bus
 
-go 1.13
+go 1.18
 
 require (
 	github.com/gorilla/websocket v1.4.1 // indirect
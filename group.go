@@ -0,0 +1,50 @@
+package eventbus
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// SetOnPartitionsAssigned sets a callback for when the server assigns
+// partitions to this consumer, see Config.ConsumerGroup.
+func (eb *Eventbus) SetOnPartitionsAssigned(f func(partitions []int32)) {
+	eb.onAssigned = f
+}
+
+// SetOnPartitionsRevoked sets a callback for when the server takes partitions
+// away from this consumer, see Config.ConsumerGroup. Offsets held back by
+// SetCommitInterval for the revoked partitions are committed before it is
+// called, so the next owner resumes after the last handled message.
+func (eb *Eventbus) SetOnPartitionsRevoked(f func(partitions []int32)) {
+	eb.onRevoked = f
+}
+
+// handleRebalance commits the pending offsets of revoked partitions and passes
+// the partitions in a rebalance frame, sent by the server as
+// {"assigned": [0, 1]} or {"revoked": [2]}, to the callbacks. If the offsets
+// cannot be committed the revoke callback is not called and the error is
+// returned, so the connection is recycled.
+func (eb *Eventbus) handleRebalance(p framePeek) error {
+	var assigned, revoked []int32
+	if p.Assigned != nil {
+		if err := json.Unmarshal(*p.Assigned, &assigned); err != nil {
+			return errors.Wrap(err, "unmarshalling assigned partitions")
+		}
+	}
+	if p.Revoked != nil {
+		if err := json.Unmarshal(*p.Revoked, &revoked); err != nil {
+			return errors.Wrap(err, "unmarshalling revoked partitions")
+		}
+		if err := eb.commitPartitions(revoked); err != nil {
+			return errors.Wrap(err, "committing revoked partitions")
+		}
+		if eb.onRevoked != nil {
+			eb.onRevoked(revoked)
+		}
+	}
+	if p.Assigned != nil && eb.onAssigned != nil {
+		eb.onAssigned(assigned)
+	}
+	return nil
+}
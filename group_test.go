@@ -0,0 +1,54 @@
+package eventbus_test
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	eventbus "github.com/luzcn6/event-bus"
+)
+
+func TestRebalanceFrames(t *testing.T) {
+	tests := []struct {
+		name  string
+		group string
+		want  []string
+	}{
+		{"group member", "workers", []string{"revoked [1]", "assigned [0 2]"}},
+		{"no group", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSession(t,
+				`{"revoked":[1]}`,
+				`{"assigned":[0,2]}`,
+				`{"offset":1,"partition":0,"body":{}}`,
+			)
+			h := &recorder{}
+			store := eventbus.NewInMemoryOffsetStore()
+			eb := eventbus.NewEventbus(eventbus.Config{Endpoint: s.Endpoint(), Stream: "stream", ConsumerGroup: tt.group}, h, store)
+			eb.Reconnection = eventbus.NewConstantReconnectionPolicy(0).NewScheduler()
+			eb.SetErrorLogger(func(err error) { t.Log("eventbus:", err) })
+			var mu sync.Mutex
+			var calls []string
+			record := func(kind string) func([]int32) {
+				return func(p []int32) {
+					mu.Lock()
+					defer mu.Unlock()
+					calls = append(calls, kind+" "+fmt.Sprint(p))
+				}
+			}
+			eb.SetOnPartitionsRevoked(record("revoked"))
+			eb.SetOnPartitionsAssigned(record("assigned"))
+			run(t, eb)
+
+			waitFor(t, "offset 1 to be committed", func() bool { return storedOffset(store, 0) == 1 })
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(calls, tt.want) {
+				t.Errorf("callbacks = %q, want %q", calls, tt.want)
+			}
+		})
+	}
+}
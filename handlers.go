@@ -0,0 +1,274 @@
+package eventbus
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ForwardingHandler is an EventHandler that passes selected messages on to a
+// sink, such as a producer for another stream, for building relays on top of a
+// consumer. A sink error is returned from Handle, so the offset is only
+// committed once the message has been forwarded.
+type ForwardingHandler struct {
+	// Sink receives each forwarded message.
+	Sink func(Message) error
+	// Filter selects the messages to forward, a nil Filter forwards every
+	// message. Messages that are not selected are treated as handled.
+	Filter func(Message) bool
+}
+
+// NewForwardingHandler creates a new ForwardingHandler that forwards every
+// message to sink.
+func NewForwardingHandler(sink func(Message) error) *ForwardingHandler {
+	return &ForwardingHandler{Sink: sink}
+}
+
+// Handle implements EventHandler for the ForwardingHandler.
+func (h *ForwardingHandler) Handle(m Message) error {
+	if h.Filter != nil && !h.Filter(m) {
+		return nil
+	}
+	return h.Sink(m)
+}
+
+// NDJSONHandler is an EventHandler that exposes the messages it handles as
+// newline-delimited JSON through its Read method, for piping the stream into
+// tools that read JSON lines. Handle blocks until the line has been read, so
+// an offset is only committed once its message has been consumed.
+type NDJSONHandler struct {
+	r    *io.PipeReader
+	w    *io.PipeWriter
+	full bool
+}
+
+// NewNDJSONHandler creates a new NDJSONHandler writing each message body on
+// its own line, or the whole Message, offset and partition included, if
+// fullMessage is true.
+func NewNDJSONHandler(fullMessage bool) *NDJSONHandler {
+	r, w := io.Pipe()
+	return &NDJSONHandler{r: r, w: w, full: fullMessage}
+}
+
+// Read implements io.Reader, returning io.EOF once the handler is closed.
+func (h *NDJSONHandler) Read(p []byte) (int, error) {
+	return h.r.Read(p)
+}
+
+// Close ends the stream, Read returns io.EOF once the lines written so far
+// have been read and Handle fails from then on.
+func (h *NDJSONHandler) Close() error {
+	return h.w.Close()
+}
+
+// Handle implements EventHandler for the NDJSONHandler.
+func (h *NDJSONHandler) Handle(m Message) error {
+	var line bytes.Buffer
+	if h.full {
+		encoded, err := json.Marshal(m)
+		if err != nil {
+			return errors.Wrapf(err, "encoding partition %d offset %d in NDJSONHandler", m.Partition, m.Offset)
+		}
+		line.Write(encoded)
+	} else if err := json.Compact(&line, m.Body); err != nil {
+		return errors.Wrapf(err, "compacting body of partition %d offset %d in NDJSONHandler", m.Partition, m.Offset)
+	}
+	line.WriteByte('\n')
+	_, err := h.w.Write(line.Bytes())
+	return err
+}
+
+// A CommitFunc commits the offset of the message it was passed with.
+type CommitFunc func() error
+
+// A TransactionalEventHandler handles a message and takes responsibility for
+// committing its offset, so the commit can be made part of the handler's own
+// transaction. The Eventbus never commits offsets for messages passed to
+// HandleTx.
+//
+// A handler can call commit once its transaction has succeeded, or, when the
+// offset store reads from the same database, write m.Partition and m.Offset
+// within the transaction itself and not call commit at all. If neither happens
+// the message is redelivered after the next reconnect.
+type TransactionalEventHandler interface {
+	HandleTx(m Message, commit CommitFunc) error
+}
+
+// TransactionalEventHandlerFunc is an adapter type to allow the use of
+// ordinary functions as a TransactionalEventHandler.
+type TransactionalEventHandlerFunc func(Message, CommitFunc) error
+
+// HandleTx implements TransactionalEventHandler for the
+// TransactionalEventHandlerFunc adapter type.
+func (f TransactionalEventHandlerFunc) HandleTx(m Message, commit CommitFunc) error {
+	return f(m, commit)
+}
+
+// SetTransactionalHandler makes h handle every message in place of the
+// EventHandler and any partition handlers. The run loop stops committing
+// offsets itself, so the delivery mode no longer applies.
+func (eb *Eventbus) SetTransactionalHandler(h TransactionalEventHandler) {
+	eb.txHandler = h
+}
+
+// A RawEventHandler handles messages from their raw frames, for consumers that
+// decode the body themselves or forward it unchanged, saving the copy of the
+// body into a Message. The frame is the whole JSON frame as received, body
+// included, and is only valid until HandleRaw returns.
+type RawEventHandler interface {
+	HandleRaw(frame []byte, partition int32, offset int64) error
+}
+
+// RawEventHandlerFunc is an adapter type to allow the use of ordinary
+// functions as a RawEventHandler.
+type RawEventHandlerFunc func(frame []byte, partition int32, offset int64) error
+
+// HandleRaw implements RawEventHandler for the RawEventHandlerFunc adapter
+// type.
+func (f RawEventHandlerFunc) HandleRaw(frame []byte, partition int32, offset int64) error {
+	return f(frame, partition, offset)
+}
+
+// SetRawHandler makes h handle messages in place of the EventHandler, passing
+// each message's frame undecoded. Offsets are committed as for the
+// EventHandler, and errors are handled the same way. Partition handlers,
+// messages in batch frames and a TransactionalEventHandler still receive a
+// decoded Message, and SetValidateBodies does not apply to raw frames. A nil
+// handler, the default, restores the EventHandler.
+func (eb *Eventbus) SetRawHandler(h RawEventHandler) {
+	eb.rawHandler = h
+}
+
+// handle passes m to its handler, or its frame to the raw handler when it was
+// not decoded.
+func (eb *Eventbus) handle(m Message) error {
+	if eb.rawFrame != nil {
+		return eb.rawHandler.HandleRaw(eb.rawFrame, m.Partition, m.Offset)
+	}
+	return eb.handlerFor(m.Partition).Handle(m)
+}
+
+// rawHandlerFor reports whether messages from the partition go to the raw
+// handler.
+func (eb *Eventbus) rawHandlerFor(partition int32) bool {
+	if eb.rawHandler == nil || eb.txHandler != nil {
+		return false
+	}
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	_, ok := eb.partitionHandlers[partition]
+	return !ok
+}
+
+// SetPartitionHandler routes messages from the partition to handler instead of
+// the Eventbus's EventHandler. It is safe to call while running, a message that
+// is already being handled finishes with the handler it was given and the new
+// handler applies from the next message.
+func (eb *Eventbus) SetPartitionHandler(partition int32, handler EventHandler) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	if eb.partitionHandlers == nil {
+		eb.partitionHandlers = make(map[int32]EventHandler)
+	}
+	eb.partitionHandlers[partition] = handler
+}
+
+// RemovePartitionHandler stops routing messages from the partition to its own
+// handler, so they fall back to the Eventbus's EventHandler. As with
+// SetPartitionHandler, a message already being handled is not affected.
+func (eb *Eventbus) RemovePartitionHandler(partition int32) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	delete(eb.partitionHandlers, partition)
+}
+
+func (eb *Eventbus) handlerFor(partition int32) EventHandler {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	if h, ok := eb.partitionHandlers[partition]; ok {
+		return h
+	}
+	return eb.eventHandler
+}
+
+// TypedHandler returns an EventHandler that decodes each message body into a
+// T and passes it to fn along with the message. A body that cannot be decoded
+// is returned as a handler error.
+func TypedHandler[T any](fn func(T, Message) error) EventHandler {
+	return EventHandlerFunc(func(m Message) error {
+		var v T
+		if err := json.Unmarshal(m.Body, &v); err != nil {
+			return errors.Wrapf(err, "decoding body of partition %d offset %d in TypedHandler", m.Partition, m.Offset)
+		}
+		return fn(v, m)
+	})
+}
+
+// A TypeRegistry records the type that message bodies decode into for each
+// stream, for consumers of several streams that carry different payloads.
+// It is safe for concurrent use.
+type TypeRegistry struct {
+	mu    sync.RWMutex
+	types map[string]reflect.Type
+}
+
+// NewTypeRegistry creates an empty TypeRegistry.
+func NewTypeRegistry() *TypeRegistry {
+	return &TypeRegistry{types: make(map[string]reflect.Type)}
+}
+
+// RegisterType decodes the bodies of messages from stream into new values of
+// the type of prototype. If prototype is a pointer, such as &Order{}, handlers
+// receive a pointer to a new Order, otherwise an Order. Registering a stream
+// again replaces its type, and a nil prototype removes it.
+func (r *TypeRegistry) RegisterType(stream string, prototype interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if prototype == nil {
+		delete(r.types, stream)
+		return
+	}
+	r.types[stream] = reflect.TypeOf(prototype)
+}
+
+// Handler returns an EventHandler that decodes each message body into the
+// type registered for the message's Stream and passes it to fn along with the
+// message. Messages from streams with no registered type, including frames
+// without a stream, are passed with the body as a json.RawMessage. As with
+// TypedHandler, a body that cannot be decoded is returned as a handler error.
+func (r *TypeRegistry) Handler(fn func(v interface{}, m Message) error) EventHandler {
+	return EventHandlerFunc(func(m Message) error {
+		r.mu.RLock()
+		t, ok := r.types[m.Stream]
+		r.mu.RUnlock()
+		if !ok {
+			return fn(m.Body, m)
+		}
+		v, err := decodeAs(t, m.Body)
+		if err != nil {
+			return errors.Wrapf(err, "decoding body of stream %q partition %d offset %d in TypeRegistry", m.Stream, m.Partition, m.Offset)
+		}
+		return fn(v, m)
+	})
+}
+
+// decodeAs decodes body into a new value of type t, returning a pointer to
+// it if t is a pointer type.
+func decodeAs(t reflect.Type, body []byte) (interface{}, error) {
+	if t.Kind() == reflect.Ptr {
+		v := reflect.New(t.Elem())
+		if err := json.Unmarshal(body, v.Interface()); err != nil {
+			return nil, err
+		}
+		return v.Interface(), nil
+	}
+	v := reflect.New(t)
+	if err := json.Unmarshal(body, v.Interface()); err != nil {
+		return nil, err
+	}
+	return v.Elem().Interface(), nil
+}
@@ -0,0 +1,48 @@
+package eventbus_test
+
+import (
+	"testing"
+	"time"
+
+	eventbus "github.com/luzcn6/event-bus"
+)
+
+type order struct {
+	ID    string `json:"id"`
+	Total int    `json:"total"`
+}
+
+func TestTypedHandler(t *testing.T) {
+	s := newSession(t, `{"offset":1,"partition":0,"body":{"id":"o-1","total":42}}`)
+	got := make(chan order, 1)
+	h := eventbus.TypedHandler(func(o order, m eventbus.Message) error {
+		got <- o
+		return nil
+	})
+	eb := newEventbus(t, s.Endpoint(), h, eventbus.NewInMemoryOffsetStore())
+	run(t, eb)
+
+	select {
+	case o := <-got:
+		if want := (order{ID: "o-1", Total: 42}); o != want {
+			t.Errorf("decoded %+v, want %+v", o, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the typed handler was not called")
+	}
+}
+
+func TestTypedHandlerDecodeError(t *testing.T) {
+	called := false
+	h := eventbus.TypedHandler(func(o order, m eventbus.Message) error {
+		called = true
+		return nil
+	})
+	err := h.Handle(eventbus.Message{Offset: 1, Body: []byte(`{"total":"many"}`)})
+	if err == nil {
+		t.Error("Handle() = nil, want the decode error")
+	}
+	if called {
+		t.Error("the typed function was called with an undecodable body")
+	}
+}
@@ -0,0 +1,162 @@
+package eventbus
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SetHandshakeRetries configures how a failed handshake write is retried.
+// A websocket connection cannot be written to again once a write has failed,
+// so each retry dials a new connection after delay, bypassing the
+// reconnection policy's backoff, up to retries times in a row before the
+// failure is treated like any other and the policy applies. The default is
+// one retry after 100ms.
+func (eb *Eventbus) SetHandshakeRetries(retries int, delay time.Duration) {
+	eb.handshakeRetries = retries
+	eb.handshakeRetryDelay = delay
+}
+
+// handshakeSendError marks a failure to write the handshake.
+type handshakeSendError struct {
+	err error
+}
+
+func (e *handshakeSendError) Error() string {
+	return e.err.Error()
+}
+
+// retryHandshake drops the connection and arranges a quick redial when err is
+// a handshake write failure with retries left.
+func (eb *Eventbus) retryHandshake(err error) bool {
+	if _, ok := errors.Cause(err).(*handshakeSendError); !ok {
+		return false
+	}
+	if eb.handshakeFailures >= eb.handshakeRetries {
+		eb.handshakeFailures = 0
+		return false
+	}
+	eb.handshakeFailures++
+	eb.logError(err)
+	eb.disconnect()
+	eb.redialAfter = &eb.handshakeRetryDelay
+	return true
+}
+
+// redialDelay returns the delay before a quick redial, if one is due.
+func (eb *Eventbus) redialDelay() (time.Duration, bool) {
+	if eb.redialAfter == nil {
+		return 0, false
+	}
+	d := *eb.redialAfter
+	eb.redialAfter = nil
+	return d, true
+}
+
+// HandshakeState is the resume position sent in the state field of a
+// handshake. The server is sent the committed offsets when the store has any,
+// and otherwise the starting position.
+type HandshakeState struct {
+	// Offsets are the committed offsets sent, including partitions added by
+	// SetFillMissingPartitions, or nil if the starting position was sent.
+	Offsets PartitionOffsets
+	// Starting is the starting position sent when Offsets is nil:
+	// OffsetOldest, OffsetNewest or an absolute offset.
+	Starting int64
+	// Encoded is the state field as sent, see SetOffsetEncoder.
+	Encoded string
+}
+
+// LastHandshakeState returns the resume position sent in the most recent
+// handshake, to check where the client asked the server to resume from. It
+// reports false before the first handshake, and when the offsets could not
+// be read from the store so no state was sent. The state is also written to
+// the debug logger, see SetDebugLogger.
+func (eb *Eventbus) LastHandshakeState() (HandshakeState, bool) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	if eb.lastHandshakeState == nil {
+		return HandshakeState{}, false
+	}
+	s := *eb.lastHandshakeState
+	if s.Offsets != nil {
+		s.Offsets = s.Offsets.copy()
+	}
+	return s, true
+}
+
+func (eb *Eventbus) recordHandshakeState(s *HandshakeState) {
+	switch {
+	case s == nil:
+		eb.debugf("sending handshake without state")
+	case s.Offsets != nil:
+		eb.debugf("sending handshake with offsets %v", s.Offsets)
+	default:
+		eb.debugf("sending handshake with starting offset %d", s.Starting)
+	}
+	eb.mu.Lock()
+	eb.lastHandshakeState = s
+	eb.mu.Unlock()
+}
+
+// A TranscriptFrame is a frame of a handshake transcript, see
+// SetRecordHandshake.
+type TranscriptFrame struct {
+	// Sent reports whether the client sent the frame, rather than received it.
+	Sent bool
+	Data []byte
+}
+
+// SetRecordHandshake records the frames exchanged during each handshake, for
+// conformance tests that compare protocol behaviour across server versions.
+// The transcript of the most recent connection is returned by
+// HandshakeTranscript. Received frames are recorded after any renaming by
+// WithFrameKeys, and the client's response includes the authentication token,
+// so transcripts should be kept as carefully as the credentials. It is off by
+// default.
+func (eb *Eventbus) SetRecordHandshake(enabled bool) {
+	eb.recordHandshake = enabled
+}
+
+// HandshakeTranscript returns the frames exchanged during the handshake of the
+// most recent connection, in order: the server's handshake frame, the
+// client's response, and the frames received until the client started
+// streaming, including the first message when the server sends no ready frame.
+// It returns nil unless SetRecordHandshake is enabled.
+func (eb *Eventbus) HandshakeTranscript() []TranscriptFrame {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	if eb.transcript == nil {
+		return nil
+	}
+	t := make([]TranscriptFrame, len(eb.transcript))
+	copy(t, eb.transcript)
+	return t
+}
+
+// startTranscript begins the transcript of a new connection.
+func (eb *Eventbus) startTranscript() {
+	if !eb.recordHandshake {
+		return
+	}
+	eb.mu.Lock()
+	eb.transcript = []TranscriptFrame{}
+	eb.mu.Unlock()
+}
+
+// recordFrame adds a frame to the transcript while the handshake is in
+// progress.
+func (eb *Eventbus) recordFrame(sent bool, data []byte) {
+	if !eb.recordHandshake {
+		return
+	}
+	switch eb.state.(type) {
+	case connecting, ready:
+	default:
+		return
+	}
+	frame := TranscriptFrame{Sent: sent, Data: append([]byte(nil), data...)}
+	eb.mu.Lock()
+	eb.transcript = append(eb.transcript, frame)
+	eb.mu.Unlock()
+}
@@ -0,0 +1,114 @@
+package eventbus
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestHandshakeGolden(t *testing.T) {
+	tests := []struct {
+		name    string
+		offsets PartitionOffsets
+	}{
+		{"handshake_starting", nil},
+		{"handshake_offsets", PartitionOffsets{0: 42, 3: 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewInMemoryOffsetStore()
+			for p, o := range tt.offsets {
+				if err := store.SetOffset(p, o); err != nil {
+					t.Fatal(err)
+				}
+			}
+			config := Config{
+				Endpoint:  "ws://eventbus.invalid",
+				AuthToken: "secret",
+				Stream:    "orders",
+				Client:    "billing",
+				Version:   "1.2.0",
+			}
+			eb := NewEventbus(config, EventHandlerFunc(func(Message) error { return nil }), store)
+
+			got, err := eb.handshakeBytes("server-1")
+			if err != nil {
+				t.Fatalf("handshakeBytes() error = %v", err)
+			}
+			golden := filepath.Join("testdata", tt.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, append(got, '\n'), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, bytes.TrimSuffix(want, []byte("\n"))) {
+				t.Errorf("handshake =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+// unmarshalableEncoder encodes offsets as the default encoder would if the
+// offsets could not be marshalled.
+type unmarshalableEncoder struct {
+	DefaultOffsetEncoder
+}
+
+func (unmarshalableEncoder) EncodeOffsets(PartitionOffsets) (string, error) {
+	_, err := json.Marshal(map[string]interface{}{"p": func() {}})
+	return "", err
+}
+
+func TestHandshakeEncodeErrorIsReturned(t *testing.T) {
+	store := NewInMemoryOffsetStore()
+	if err := store.SetOffset(0, 42); err != nil {
+		t.Fatal(err)
+	}
+	eb := NewEventbus(Config{Stream: "orders"}, EventHandlerFunc(func(Message) error { return nil }), store)
+	eb.SetOffsetEncoder(unmarshalableEncoder{})
+
+	defer func() {
+		if x := recover(); x != nil {
+			t.Fatalf("handshakeBytes panicked: %v", x)
+		}
+	}()
+	if _, err := eb.handshakeBytes("server-1"); err == nil {
+		t.Error("handshakeBytes() error = nil, want the marshalling error")
+	}
+}
+
+func TestEncodeState(t *testing.T) {
+	tests := []struct {
+		name   string
+		encode func() (string, error)
+		want   string
+	}{
+		{"offsets", func() (string, error) { return encodeOffsets(PartitionOffsets{1: 9}) }, `{"p":{"1":"9"}}`},
+		{"starting", func() (string, error) { return encodeStarting(OffsetNewest) }, `{"d":"-1"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := tt.encode()
+			if err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			decoded, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				t.Fatalf("state %q is not base64: %v", encoded, err)
+			}
+			if string(decoded) != tt.want {
+				t.Errorf("state = %s, want %s", decoded, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package eventbus
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WithHeartbeat sends an application frame built by payload every interval
+// while streaming, for server configurations that expect the client to prove
+// it is alive. Unlike Ping it sends a text frame. The heartbeat stops when the
+// connection drops and starts again once the next connection is streaming.
+// A write failure is logged, a dead connection is detected by the read side.
+func WithHeartbeat(interval time.Duration, payload func() []byte) Option {
+	return func(eb *Eventbus) {
+		eb.heartbeatInterval = interval
+		eb.heartbeatPayload = payload
+	}
+}
+
+// startHeartbeat starts sending heartbeats on the current connection.
+func (eb *Eventbus) startHeartbeat() {
+	if eb.heartbeatInterval <= 0 || eb.heartbeatPayload == nil || eb.stopHeartbeats != nil {
+		return
+	}
+	socket := eb.socket
+	interval := eb.heartbeatInterval
+	payload := eb.heartbeatPayload
+	quit := make(chan struct{})
+	eb.stopHeartbeats = quit
+	go func() {
+		for {
+			select {
+			case <-eb.clock.After(interval):
+			case <-quit:
+				return
+			}
+			if err := eb.writeMessage(socket, payload()); err != nil {
+				eb.logError(err)
+			}
+		}
+	}()
+}
+
+// stopHeartbeat stops the heartbeats started for the current connection.
+func (eb *Eventbus) stopHeartbeat() {
+	if eb.stopHeartbeats != nil {
+		close(eb.stopHeartbeats)
+		eb.stopHeartbeats = nil
+	}
+}
+
+// writeMessage writes a text frame, serialised with the other frames written
+// to the connection.
+func (eb *Eventbus) writeMessage(s socketClient, data []byte) error {
+	eb.writeMu.Lock()
+	defer eb.writeMu.Unlock()
+	if err := s.WriteMessage(websocket.TextMessage, data); err != nil {
+		return err
+	}
+	eb.stats.wrote(len(data))
+	return nil
+}
@@ -0,0 +1,134 @@
+package eventbus_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	eventbus "github.com/luzcn6/event-bus"
+	"github.com/luzcn6/event-bus/eventbustest"
+)
+
+// session is a Server that completes the handshake on every connection and
+// then sends frames, keeping the connection open until the client closes it.
+type session struct {
+	*eventbustest.Server
+	handshakes chan map[string]string
+}
+
+func newSession(t *testing.T, frames ...string) *session {
+	t.Helper()
+	return newScriptedSession(t, `{"id":"srv"}`, `{"status":"ok"}`, frames...)
+}
+
+// newScriptedSession is newSession with the greeting and ready frames given,
+// for servers that name their fields differently.
+func newScriptedSession(t *testing.T, greeting, ready string, frames ...string) *session {
+	t.Helper()
+	s := &session{handshakes: make(chan map[string]string, 100)}
+	s.Server = eventbustest.NewServer(func(c *websocket.Conn) {
+		if err := c.WriteMessage(websocket.TextMessage, []byte(greeting)); err != nil {
+			return
+		}
+		var h map[string]string
+		if err := c.ReadJSON(&h); err != nil {
+			return
+		}
+		s.handshakes <- h
+		for _, f := range append([]string{ready}, frames...) {
+			if err := c.WriteMessage(websocket.TextMessage, []byte(f)); err != nil {
+				return
+			}
+		}
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	t.Cleanup(s.Close)
+	return s
+}
+
+// handshake returns the next handshake the session received.
+func (s *session) handshake(t *testing.T) map[string]string {
+	t.Helper()
+	select {
+	case h := <-s.handshakes:
+		return h
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for handshake")
+		return nil
+	}
+}
+
+// recorder is an EventHandler that records the messages it handles, failing
+// with the error returned by fail, if set.
+type recorder struct {
+	mu       sync.Mutex
+	messages []eventbus.Message
+	fail     func(eventbus.Message) error
+}
+
+func (r *recorder) Handle(m eventbus.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, m)
+	if r.fail != nil {
+		return r.fail(m)
+	}
+	return nil
+}
+
+func (r *recorder) offsets() []int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var offsets []int64
+	for _, m := range r.messages {
+		offsets = append(offsets, m.Offset)
+	}
+	return offsets
+}
+
+// newEventbus creates an Eventbus for endpoint that reconnects without delay
+// and logs errors to the test.
+func newEventbus(t *testing.T, endpoint string, h eventbus.EventHandler, store *eventbus.InMemoryOffsetStore, opts ...eventbus.Option) *eventbus.Eventbus {
+	t.Helper()
+	eb := eventbus.NewEventbus(eventbus.Config{Endpoint: endpoint, Stream: "stream"}, h, store, opts...)
+	eb.Reconnection = eventbus.NewConstantReconnectionPolicy(0).NewScheduler()
+	eb.SetErrorLogger(func(err error) { t.Log("eventbus:", err) })
+	return eb
+}
+
+// run starts eb and stops it when the test ends.
+func run(t *testing.T, eb *eventbus.Eventbus) <-chan error {
+	t.Helper()
+	done := eb.Run()
+	t.Cleanup(func() { eb.Stop() })
+	return done
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// storedOffset returns the offset stored for the partition, or -1.
+func storedOffset(store *eventbus.InMemoryOffsetStore, partition int32) int64 {
+	offsets, _ := store.GetOffsets()
+	if offsets == nil {
+		return -1
+	}
+	if o, ok := (*offsets)[partition]; ok {
+		return o
+	}
+	return -1
+}
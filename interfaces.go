@@ -11,6 +11,14 @@ type ReconnectionScheduler interface {
 	NextReconnectBackoff() (time.Duration, error)
 }
 
+// ResettableScheduler is a ReconnectionScheduler that can go back to its
+// initial backoff. The Eventbus resets its scheduler once a connection reaches
+// the streaming state, so that backoff only grows across consecutive failures.
+type ResettableScheduler interface {
+	ReconnectionScheduler
+	Reset()
+}
+
 // ReconnectionPolicy returns a ReconnectionScheduler to be used when attempting
 // to reconnect.
 type ReconnectionPolicy interface {
@@ -0,0 +1,105 @@
+package eventbus
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SetErrorLogDeduplication collapses repeated identical errors passed to the
+// error logger. The first occurrence is logged, repeats are counted and a
+// "still failing" summary is logged at most once per interval, or when a
+// different error arrives. A zero interval disables deduplication, which is
+// the default.
+func (eb *Eventbus) SetErrorLogDeduplication(interval time.Duration) {
+	var d *errorDeduplicator
+	if interval > 0 {
+		d = &errorDeduplicator{interval: interval}
+	}
+	eb.logMu.Lock()
+	eb.errorDedup = d
+	eb.logMu.Unlock()
+}
+
+// WithErrorChannel also sends every error passed to the error logger, before
+// any deduplication, to errs so the caller can react to them. Sends never
+// block, errors are dropped when errs is full.
+func WithErrorChannel(errs chan error) Option {
+	return func(eb *Eventbus) {
+		eb.logMu.Lock()
+		eb.errorChan = errs
+		eb.logMu.Unlock()
+	}
+}
+
+// SetDebugLogger sets a logger for diagnostic messages, such as frames the
+// client ignores and the resume position sent in each handshake. They are
+// discarded by default.
+func (eb *Eventbus) SetDebugLogger(logger func(format string, args ...interface{})) {
+	eb.debugLogger = logger
+}
+
+func (eb *Eventbus) debugf(format string, args ...interface{}) {
+	if eb.debugLogger != nil {
+		eb.debugLogger(format, args...)
+	}
+}
+
+// logError is called from the run loop and the background goroutines, such
+// as the heartbeat and the watchdog, while Reconfigure may swap the logger on
+// the run loop, so the sinks are read under logMu.
+func (eb *Eventbus) logError(err error) {
+	eb.logMu.RLock()
+	logger, dedup, errs := eb.errorLogger, eb.errorDedup, eb.errorChan
+	eb.logMu.RUnlock()
+	if errs != nil {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	if dedup == nil {
+		logger(err)
+		return
+	}
+	for _, e := range dedup.filter(err, eb.clock.Now()) {
+		logger(e)
+	}
+}
+
+type errorDeduplicator struct {
+	sync.Mutex
+	interval time.Duration
+	last     string
+	repeats  int
+	emitted  time.Time
+}
+
+// filter returns the errors that should be passed on to the logger for err.
+func (d *errorDeduplicator) filter(err error, now time.Time) []error {
+	d.Lock()
+	defer d.Unlock()
+	msg := err.Error()
+	if msg != d.last {
+		var out []error
+		if d.repeats > 0 {
+			out = append(out, repeatedError(d.last, d.repeats))
+		}
+		d.last = msg
+		d.repeats = 0
+		d.emitted = now
+		return append(out, err)
+	}
+	d.repeats++
+	if now.Sub(d.emitted) < d.interval {
+		return nil
+	}
+	out := []error{repeatedError(msg, d.repeats)}
+	d.repeats = 0
+	d.emitted = now
+	return out
+}
+
+func repeatedError(msg string, n int) error {
+	return fmt.Errorf("still failing, %d times: %s", n, msg)
+}
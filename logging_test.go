@@ -0,0 +1,31 @@
+package eventbus_test
+
+import (
+	"errors"
+	"testing"
+
+	eventbus "github.com/luzcn6/event-bus"
+)
+
+func TestNilErrorLogger(t *testing.T) {
+	s := newSession(t, `{"offset":1,"partition":0,"body":{}}`)
+	failed := false
+	h := &recorder{fail: func(m eventbus.Message) error {
+		if !failed {
+			failed = true
+			return errors.New("logged to a nil logger")
+		}
+		return nil
+	}}
+	store := eventbus.NewInMemoryOffsetStore()
+	eb := newEventbus(t, s.Endpoint(), h, store)
+	eb.SetErrorLogger(nil)
+	done := run(t, eb)
+
+	waitFor(t, "offset 1 to be committed", func() bool { return storedOffset(store, 0) == 1 })
+	select {
+	case err := <-done:
+		t.Fatalf("Run() exited with %v after an error was logged", err)
+	default:
+	}
+}
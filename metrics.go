@@ -0,0 +1,41 @@
+package eventbus
+
+import (
+	"time"
+)
+
+// Metrics receives measurements from the Eventbus.
+type Metrics interface {
+	// ObserveTimeToFirstMessage is called with the time from dialing to the
+	// first message being handled, once for each connection.
+	ObserveTimeToFirstMessage(time.Duration)
+}
+
+// commitDurationObserver is implemented by Metrics that also measure how long
+// the offset store takes to write each offset.
+type commitDurationObserver interface {
+	// ObserveCommitDuration is called with the duration of each attempt to
+	// write an offset to the store, whether or not it succeeded.
+	ObserveCommitDuration(time.Duration)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveTimeToFirstMessage(time.Duration) {}
+
+// SetMetrics sets the Metrics that measurements are reported to. Metrics
+// with an ObserveCommitDuration(time.Duration) method also receive the
+// latency of each offset store write, separate from handler latency.
+func (eb *Eventbus) SetMetrics(m Metrics) {
+	eb.metrics = m
+}
+
+// observeFirstMessage reports the time to the first handled message if it is
+// the first since connecting.
+func (eb *Eventbus) observeFirstMessage() {
+	if eb.dialledAt.IsZero() {
+		return
+	}
+	eb.metrics.ObserveTimeToFirstMessage(eb.clock.Now().Sub(eb.dialledAt))
+	eb.dialledAt = time.Time{}
+}
@@ -0,0 +1,114 @@
+package eventbus
+
+import "io"
+
+// MultiOffsetStore writes offsets to several stores, such as Redis and a local
+// fallback, so offsets survive one of them being unavailable.
+type MultiOffsetStore struct {
+	stores []offsetStore
+}
+
+// NewMultiOffsetStore creates a MultiOffsetStore over stores, in order of read
+// precedence.
+func NewMultiOffsetStore(stores ...offsetStore) *MultiOffsetStore {
+	return &MultiOffsetStore{stores: stores}
+}
+
+// GetOffsets returns the offsets from the first store, in the order given to
+// NewMultiOffsetStore, that returns offsets without an error. Stores that fail
+// or hold no offsets are skipped, so a fallback is only read when the stores
+// before it cannot answer. It returns nil, nil when no store holds offsets,
+// and the first error only when every store failed.
+func (ms *MultiOffsetStore) GetOffsets() (*PartitionOffsets, error) {
+	var firstErr error
+	failed := 0
+	for _, s := range ms.stores {
+		offsets, err := s.GetOffsets()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+			continue
+		}
+		if offsets != nil {
+			return offsets, nil
+		}
+	}
+	if failed > 0 && failed == len(ms.stores) {
+		return nil, firstErr
+	}
+	return nil, nil
+}
+
+// SetOffset writes the offset to every store. It is best effort: it only
+// returns an error, the first, when every store failed.
+func (ms *MultiOffsetStore) SetOffset(partition int32, offset int64) error {
+	return ms.each(func(s offsetStore) error {
+		return s.SetOffset(partition, offset)
+	})
+}
+
+// SetOffsetWithMeta writes the offset to every store, with the metadata for
+// those that support it. Like SetOffset, it only fails when every store failed.
+func (ms *MultiOffsetStore) SetOffsetWithMeta(partition int32, offset int64, meta map[string]string) error {
+	return ms.each(func(s offsetStore) error {
+		if m, ok := s.(offsetMetaStore); ok {
+			return m.SetOffsetWithMeta(partition, offset, meta)
+		}
+		return s.SetOffset(partition, offset)
+	})
+}
+
+// ResetOffsets discards the offsets in every store, so that ResetToOldest and
+// ResetToNewest work over a MultiOffsetStore. Unlike writes it is not best
+// effort, as offsets left in any store would be read back: it returns
+// ErrResetUnsupported, without resetting any store, if one of them cannot be
+// reset, and otherwise the first error from a store that failed.
+func (ms *MultiOffsetStore) ResetOffsets() error {
+	for _, s := range ms.stores {
+		if _, ok := s.(offsetResetter); !ok {
+			return ErrResetUnsupported
+		}
+	}
+	var firstErr error
+	for _, s := range ms.stores {
+		if err := s.(offsetResetter).ResetOffsets(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close closes the stores that implement io.Closer, returning the first
+// error.
+func (ms *MultiOffsetStore) Close() error {
+	var firstErr error
+	for _, s := range ms.stores {
+		if c, ok := s.(io.Closer); ok {
+			if err := c.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// each calls f with every store, returning the first error only if every call
+// failed.
+func (ms *MultiOffsetStore) each(f func(offsetStore) error) error {
+	var firstErr error
+	failed := 0
+	for _, s := range ms.stores {
+		if err := f(s); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+		}
+	}
+	if failed > 0 && failed == len(ms.stores) {
+		return firstErr
+	}
+	return nil
+}
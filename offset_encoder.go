@@ -0,0 +1,52 @@
+package eventbus
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// An OffsetEncoder encodes the resume position sent as the state field of the
+// handshake. An encoding error fails the handshake and the client reconnects.
+type OffsetEncoder interface {
+	// EncodeOffsets encodes the committed offset for each partition.
+	EncodeOffsets(PartitionOffsets) (string, error)
+	// EncodeStarting encodes the position to start from when no offsets have
+	// been committed: OffsetOldest, OffsetNewest, or an absolute offset of zero
+	// or more given to StartAtOffset.
+	EncodeStarting(int64) (string, error)
+}
+
+// DefaultOffsetEncoder encodes the state as base64 JSON, {"p": offsets} when
+// there are committed offsets and {"d": position} otherwise.
+type DefaultOffsetEncoder struct{}
+
+// EncodeOffsets implements OffsetEncoder.
+func (DefaultOffsetEncoder) EncodeOffsets(offsets PartitionOffsets) (string, error) {
+	return encodeOffsets(offsets)
+}
+
+// EncodeStarting implements OffsetEncoder.
+func (DefaultOffsetEncoder) EncodeStarting(position int64) (string, error) {
+	return encodeStarting(position)
+}
+
+func encodeOffsets(offsets PartitionOffsets) (string, error) {
+	data := map[string]PartitionOffsets{"p": offsets}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal partition offset data: %s", err)
+	}
+	return base64.StdEncoding.EncodeToString(encoded), nil
+}
+
+// Eventbus has an undocumented {"d": sarama offset} feature
+func encodeStarting(position int64) (string, error) {
+	data := map[string]string{"d": strconv.FormatInt(position, 10)}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal starting offset data: %s", err)
+	}
+	return base64.StdEncoding.EncodeToString(encoded), nil
+}
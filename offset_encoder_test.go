@@ -0,0 +1,53 @@
+package eventbus_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	eventbus "github.com/luzcn6/event-bus"
+)
+
+// failingEncoder fails the first fails encodings, then encodes as the
+// DefaultOffsetEncoder does.
+type failingEncoder struct {
+	eventbus.DefaultOffsetEncoder
+	mu    sync.Mutex
+	fails int
+}
+
+func (e *failingEncoder) EncodeStarting(position int64) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.fails > 0 {
+		e.fails--
+		return "", errors.New("codec unavailable")
+	}
+	return e.DefaultOffsetEncoder.EncodeStarting(position)
+}
+
+func TestOffsetEncoderErrorReconnects(t *testing.T) {
+	s := newSession(t, `{"offset":1,"partition":0,"body":{}}`)
+	store := eventbus.NewInMemoryOffsetStore()
+	errs := make(chan error, 10)
+	eb := newEventbus(t, s.Endpoint(), &recorder{}, store, eventbus.WithErrorChannel(errs))
+	eb.SetOffsetEncoder(&failingEncoder{fails: 1})
+	done := run(t, eb)
+
+	select {
+	case err := <-errs:
+		t.Log("logged:", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the codec error was not logged")
+	}
+	waitFor(t, "offset 1 to be committed", func() bool { return storedOffset(store, 0) == 1 })
+	if n := eb.ReconnectAttempts(); n != 1 {
+		t.Errorf("ReconnectAttempts() = %d, want 1", n)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Run() exited with %v, want the codec error recovered by reconnecting", err)
+	default:
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -24,13 +26,41 @@ func (po PartitionOffsets) MarshalJSON() ([]byte, error) {
 	return json.Marshal(data)
 }
 
+func (po PartitionOffsets) copy() PartitionOffsets {
+	c := make(PartitionOffsets, len(po))
+	for k, v := range po {
+		c[k] = v
+	}
+	return c
+}
+
 type offsetStore interface {
 	SetOffset(int32, int64) error
 	GetOffsets() (*PartitionOffsets, error)
 }
 
+// offsetMetaStore is implemented by stores that can record metadata, such as
+// the commit time, alongside an offset.
+type offsetMetaStore interface {
+	SetOffsetWithMeta(int32, int64, map[string]string) error
+}
+
+// offsetResetter is implemented by stores that can discard all recorded
+// offsets.
+type offsetResetter interface {
+	ResetOffsets() error
+}
+
+// partitionOffsetGetter is implemented by stores that can read the offsets of
+// some partitions more cheaply than reading them all.
+type partitionOffsetGetter interface {
+	GetPartitionOffsets([]int32) (*PartitionOffsets, error)
+}
+
 // InMemoryOffsetStore is mostly for testing purposes.
+// It is safe for concurrent use.
 type InMemoryOffsetStore struct {
+	mu      sync.Mutex
 	offsets PartitionOffsets
 }
 
@@ -39,40 +69,204 @@ func NewInMemoryOffsetStore() *InMemoryOffsetStore {
 	return &InMemoryOffsetStore{offsets: make(PartitionOffsets)}
 }
 
-// GetOffsets returns either nil, nil if we have no offsets, or the current set
-// of recorded offsets and no error.
-func (os InMemoryOffsetStore) GetOffsets() (*PartitionOffsets, error) {
+// GetOffsets returns either nil, nil if we have no offsets, or a copy of the
+// current set of recorded offsets and no error.
+func (os *InMemoryOffsetStore) GetOffsets() (*PartitionOffsets, error) {
+	os.mu.Lock()
+	defer os.mu.Unlock()
 	if len(os.offsets) == 0 {
 		return nil, nil
 	}
-	return &os.offsets, nil
+	offsets := os.offsets.copy()
+	return &offsets, nil
+}
+
+// GetPartitionOffsets is like GetOffsets, but only returns the offsets of the
+// partitions given.
+func (os *InMemoryOffsetStore) GetPartitionOffsets(partitions []int32) (*PartitionOffsets, error) {
+	os.mu.Lock()
+	defer os.mu.Unlock()
+	offsets := make(PartitionOffsets, len(partitions))
+	for _, p := range partitions {
+		if offset, ok := os.offsets[p]; ok {
+			offsets[p] = offset
+		}
+	}
+	if len(offsets) == 0 {
+		return nil, nil
+	}
+	return &offsets, nil
 }
 
 // SetOffset stores the offset against the partition and always returns a nil
 // error.
 func (os *InMemoryOffsetStore) SetOffset(partition int32, offset int64) error {
+	os.mu.Lock()
+	defer os.mu.Unlock()
 	os.offsets[partition] = offset
 	return nil
 }
 
+// SetOffsetWithMeta stores the offset against the partition, the metadata is
+// ignored. It always returns a nil error.
+func (os *InMemoryOffsetStore) SetOffsetWithMeta(partition int32, offset int64, meta map[string]string) error {
+	return os.SetOffset(partition, offset)
+}
+
+// ResetOffsets discards all recorded offsets and always returns a nil error.
+func (os *InMemoryOffsetStore) ResetOffsets() error {
+	os.mu.Lock()
+	defer os.mu.Unlock()
+	os.offsets = make(PartitionOffsets)
+	return nil
+}
+
 // RedisOffsetStore uses a connection pool to record the offsets and partitions.
 type RedisOffsetStore struct {
-	prefix string
-	pool   *redis.Pool
+	prefix    string
+	namespace string
+	pool      *redis.Pool
+	scheme    RedisKeyScheme
+	ttl       time.Duration
 }
 
-// NewRedisOffsetStore creates a new RedisOffsetStore.
-func NewRedisOffsetStore(prefix string, p *redis.Pool) *RedisOffsetStore {
-	return &RedisOffsetStore{prefix: prefix, pool: p}
+// A RedisKeyScheme chooses how a RedisOffsetStore lays out offsets in Redis.
+type RedisKeyScheme int
+
+const (
+	// RedisHashKeys stores every offset in one hash, prefix:offsets, keyed by
+	// partition. It is the default.
+	RedisHashKeys RedisKeyScheme = iota
+	// RedisIndividualKeys stores each offset in its own key,
+	// prefix:offset:<partition>, which suits very large partition counts and
+	// lets each partition expire on its own. The partitions are listed in a
+	// set, prefix:offsets:partitions, so reads do not scan the keyspace.
+	RedisIndividualKeys
+)
+
+// A RedisStoreOption configures a RedisOffsetStore.
+type RedisStoreOption func(*RedisOffsetStore)
+
+// WithRedisKeyScheme chooses how offsets are keyed in Redis. Offsets written
+// with one scheme are not read by the other.
+func WithRedisKeyScheme(scheme RedisKeyScheme) RedisStoreOption {
+	return func(rs *RedisOffsetStore) {
+		rs.scheme = scheme
+	}
+}
+
+// WithRedisOffsetTTL expires stored offsets ttl after they were last written,
+// so a consumer restarted after a long quiet spell does not resume from an
+// offset the server may no longer retain. Each partition expires on its own.
+// With RedisIndividualKeys each offset key expires; with the default hash the
+// time each partition was written is kept in a sorted set,
+// prefix:offsets:written, and partitions not written for ttl are left out when
+// offsets are read. The keys themselves, and the metadata written by
+// SetOffsetWithMeta, expire once no offset has been written for ttl.
+//
+// When no offsets remain the handshake falls back to the starting offset, see
+// StartAtOffset. When only some partitions have expired they are left out of
+// the handshake and the server chooses where they start, unless they are
+// listed with SetFillMissingPartitions.
+func WithRedisOffsetTTL(ttl time.Duration) RedisStoreOption {
+	return func(rs *RedisOffsetStore) {
+		rs.ttl = ttl
+	}
+}
+
+// WithRedisNamespace keys offsets under prefix:namespace rather than prefix, so
+// several consumers can share a prefix, and a Redis pool, without clobbering
+// each other's offsets. Give each Eventbus in a process its own
+// RedisOffsetStore over the shared pool, namespaced by something that is
+// unique to the consumer, such as its stream or stream and consumer group:
+//
+//	orders := NewRedisOffsetStore("myapp", pool, WithRedisNamespace("orders"))
+//	payments := NewRedisOffsetStore("myapp", pool, WithRedisNamespace("payments"))
+//
+// Offsets stored without a namespace are not read by a namespaced store.
+func WithRedisNamespace(namespace string) RedisStoreOption {
+	return func(rs *RedisOffsetStore) {
+		rs.namespace = namespace
+	}
+}
+
+// NewRedisOffsetStore creates a new RedisOffsetStore, storing offsets in a
+// single hash unless configured otherwise.
+func NewRedisOffsetStore(prefix string, p *redis.Pool, opts ...RedisStoreOption) *RedisOffsetStore {
+	rs := &RedisOffsetStore{prefix: prefix, pool: p}
+	for _, opt := range opts {
+		opt(rs)
+	}
+	return rs
 }
 
 // GetOffsets returns the current offsets stored in Redis and possibly an error.
 func (rs RedisOffsetStore) GetOffsets() (*PartitionOffsets, error) {
+	c := rs.pool.Get()
+	defer c.Close()
+
+	if rs.scheme == RedisIndividualKeys {
+		return rs.getIndividualOffsets(c)
+	}
 	cmd, args := rs.getOffsetsCmd()
+	offsets, err := redisToPartitionOffsets(c.Do(cmd, args...))
+	if err != nil || offsets == nil {
+		return offsets, err
+	}
+	return rs.withoutExpired(c, *offsets)
+}
+
+// GetPartitionOffsets returns the offsets stored in Redis for the partitions
+// given, with a single HMGET or MGET rather than reading every partition. It
+// returns nil, nil if none of them have offsets.
+func (rs RedisOffsetStore) GetPartitionOffsets(partitions []int32) (*PartitionOffsets, error) {
+	if len(partitions) == 0 {
+		return nil, nil
+	}
 	c := rs.pool.Get()
 	defer c.Close()
 
-	return redisToPartitionOffsets(c.Do(cmd, args...))
+	return rs.getPartitionOffsets(c, partitions)
+}
+
+func (rs RedisOffsetStore) getPartitionOffsets(c redis.Conn, partitions []int32) (*PartitionOffsets, error) {
+	var values []interface{}
+	var err error
+	if rs.scheme == RedisIndividualKeys {
+		args := make([]interface{}, len(partitions))
+		for i, p := range partitions {
+			args[i] = rs.partitionKey(p)
+		}
+		values, err = redis.Values(c.Do("MGET", args...))
+	} else {
+		args := make([]interface{}, 0, len(partitions)+1)
+		args = append(args, rs.key())
+		for _, p := range partitions {
+			args = append(args, p)
+		}
+		values, err = redis.Values(c.Do("HMGET", args...))
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := make(PartitionOffsets, len(partitions))
+	for i, v := range values {
+		if v == nil || i >= len(partitions) {
+			continue
+		}
+		offset, err := redis.Int64(v, nil)
+		if err != nil {
+			return nil, err
+		}
+		m[partitions[i]] = offset
+	}
+	if len(m) == 0 {
+		return nil, nil
+	}
+	if rs.scheme == RedisHashKeys {
+		return rs.withoutExpired(c, m)
+	}
+	return &m, nil
 }
 
 // SetOffset stores the offset against the partition and returns errors returned
@@ -82,6 +276,9 @@ func (rs RedisOffsetStore) SetOffset(partition int32, offset int64) error {
 	c := rs.pool.Get()
 	defer c.Close()
 
+	if extra := rs.writeCmds(partition); len(extra) > 0 {
+		return transaction(c, append([]redisCmd{{cmd, args}}, extra...)...)
+	}
 	r, err := redis.Int(c.Do(cmd, args...))
 	if !(r == 1 || r == 0) {
 		return errors.New("failed to store offset")
@@ -90,12 +287,185 @@ func (rs RedisOffsetStore) SetOffset(partition int32, offset int64) error {
 	return err
 }
 
+// SetOffsetWithMeta stores the offset against the partition, and the metadata
+// as JSON against the partition in a parallel hash, in a single transaction.
+func (rs RedisOffsetStore) SetOffsetWithMeta(partition int32, offset int64, meta map[string]string) error {
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	c := rs.pool.Get()
+	defer c.Close()
+
+	cmd, args := rs.storeOffsetCmd(partition, offset)
+	cmds := []redisCmd{{cmd, args}, {"HSET", []interface{}{rs.metaKey(), partition, encoded}}}
+	if rs.ttl > 0 {
+		cmds = append(cmds, redisCmd{"PEXPIRE", []interface{}{rs.metaKey(), rs.ttl.Milliseconds()}})
+	}
+	return transaction(c, append(cmds, rs.writeCmds(partition)...)...)
+}
+
+type redisCmd struct {
+	name string
+	args []interface{}
+}
+
+// transaction runs the commands in a MULTI/EXEC transaction. It returns the
+// first error from sending a command, from EXEC, or from a command within the
+// transaction, which Redis reports as an element of the EXEC reply rather
+// than by failing EXEC.
+func transaction(c redis.Conn, cmds ...redisCmd) error {
+	if err := c.Send("MULTI"); err != nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		if err := c.Send(cmd.name, cmd.args...); err != nil {
+			return err
+		}
+	}
+	replies, err := redis.Values(c.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+	for _, r := range replies {
+		if err, ok := r.(redis.Error); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResetOffsets deletes the recorded offsets and their metadata from Redis.
+func (rs RedisOffsetStore) ResetOffsets() error {
+	c := rs.pool.Get()
+	defer c.Close()
+
+	keys := []interface{}{rs.key(), rs.metaKey(), rs.writtenKey()}
+	if rs.scheme == RedisIndividualKeys {
+		partitions, err := rs.partitions(c)
+		if err != nil {
+			return err
+		}
+		for _, p := range partitions {
+			keys = append(keys, rs.partitionKey(p))
+		}
+		keys = append(keys, rs.partitionSetKey())
+	}
+	_, err := c.Do("DEL", keys...)
+	return err
+}
+
 func (rs RedisOffsetStore) storeOffsetCmd(partition int32, offset int64) (string, []interface{}) {
+	if rs.scheme == RedisIndividualKeys {
+		args := []interface{}{rs.partitionKey(partition), offset}
+		if rs.ttl > 0 {
+			args = append(args, "PX", rs.ttl.Milliseconds())
+		}
+		return "SET", args
+	}
 	return "HSET", []interface{}{rs.key(), partition, offset}
 }
 
+func (rs RedisOffsetStore) partitionKey(partition int32) string {
+	return fmt.Sprintf("%s:offset:%d", rs.base(), partition)
+}
+
+// writeCmds returns the commands that accompany an offset write in its
+// transaction: with RedisIndividualKeys they add the partition to the set of
+// stored partitions, and with a TTL on the hash they record when the
+// partition was written. Either way they refresh the expiry of the keys.
+func (rs RedisOffsetStore) writeCmds(partition int32) []redisCmd {
+	ttl := rs.ttl.Milliseconds()
+	if rs.scheme == RedisIndividualKeys {
+		cmds := []redisCmd{{"SADD", []interface{}{rs.partitionSetKey(), partition}}}
+		if rs.ttl > 0 {
+			cmds = append(cmds, redisCmd{"PEXPIRE", []interface{}{rs.partitionSetKey(), ttl}})
+		}
+		return cmds
+	}
+	if rs.ttl <= 0 {
+		return nil
+	}
+	now := time.Now().UnixMilli()
+	return []redisCmd{
+		{"ZADD", []interface{}{rs.writtenKey(), now, partition}},
+		{"ZREMRANGEBYSCORE", []interface{}{rs.writtenKey(), "-inf", fmt.Sprintf("(%d", now-ttl)}},
+		{"PEXPIRE", []interface{}{rs.key(), ttl}},
+		{"PEXPIRE", []interface{}{rs.writtenKey(), ttl}},
+	}
+}
+
+// withoutExpired removes the partitions of hash stored offsets that have not
+// been written for the TTL, a partition with no recorded write time is
+// expired. They are only left out, not deleted, as another consumer may write
+// them at any moment; the hash expires once none has been written for the TTL.
+func (rs RedisOffsetStore) withoutExpired(c redis.Conn, offsets PartitionOffsets) (*PartitionOffsets, error) {
+	if rs.ttl <= 0 {
+		return &offsets, nil
+	}
+	cutoff := time.Now().Add(-rs.ttl).UnixMilli()
+	fresh, err := redis.Int64s(c.Do("ZRANGEBYSCORE", rs.writtenKey(), cutoff, "+inf"))
+	if err != nil {
+		return nil, err
+	}
+	m := make(PartitionOffsets, len(fresh))
+	for _, p := range fresh {
+		if offset, ok := offsets[int32(p)]; ok {
+			m[int32(p)] = offset
+		}
+	}
+	if len(m) == 0 {
+		return nil, nil
+	}
+	return &m, nil
+}
+
+// partitions returns the partitions with individually stored offsets.
+func (rs RedisOffsetStore) partitions(c redis.Conn) ([]int32, error) {
+	members, err := redis.Int64s(c.Do("SMEMBERS", rs.partitionSetKey()))
+	if err != nil {
+		return nil, err
+	}
+	partitions := make([]int32, len(members))
+	for i, m := range members {
+		partitions[i] = int32(m)
+	}
+	return partitions, nil
+}
+
+// getIndividualOffsets reads the offsets stored with RedisIndividualKeys.
+// Partitions whose keys have expired are treated as absent.
+func (rs RedisOffsetStore) getIndividualOffsets(c redis.Conn) (*PartitionOffsets, error) {
+	partitions, err := rs.partitions(c)
+	if err != nil || len(partitions) == 0 {
+		return nil, err
+	}
+	return rs.getPartitionOffsets(c, partitions)
+}
+
+// base returns the prefix of every key, including the namespace if there is
+// one.
+func (rs RedisOffsetStore) base() string {
+	if rs.namespace == "" {
+		return rs.prefix
+	}
+	return rs.prefix + ":" + rs.namespace
+}
+
 func (rs RedisOffsetStore) key() string {
-	return fmt.Sprintf("%s:offsets", rs.prefix)
+	return fmt.Sprintf("%s:offsets", rs.base())
+}
+
+func (rs RedisOffsetStore) metaKey() string {
+	return fmt.Sprintf("%s:offsets:meta", rs.base())
+}
+
+func (rs RedisOffsetStore) writtenKey() string {
+	return fmt.Sprintf("%s:offsets:written", rs.base())
+}
+
+func (rs RedisOffsetStore) partitionSetKey() string {
+	return fmt.Sprintf("%s:offsets:partitions", rs.base())
 }
 
 func (rs RedisOffsetStore) getOffsetsCmd() (string, []interface{}) {
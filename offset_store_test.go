@@ -0,0 +1,159 @@
+package eventbus_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	eventbus "github.com/luzcn6/event-bus"
+)
+
+// fakeRedis is a redis.Conn that records the commands sent and replies to
+// each with the result of reply, or OK.
+type fakeRedis struct {
+	cmds  []string
+	reply func(cmd string, args []interface{}) (interface{}, error)
+}
+
+func (f *fakeRedis) Close() error { return nil }
+func (f *fakeRedis) Err() error   { return nil }
+func (f *fakeRedis) Flush() error { return nil }
+
+func (f *fakeRedis) Receive() (interface{}, error) { return nil, nil }
+
+func (f *fakeRedis) Send(cmd string, args ...interface{}) error {
+	f.cmds = append(f.cmds, cmd)
+	return nil
+}
+
+func (f *fakeRedis) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "" {
+		return nil, nil
+	}
+	f.cmds = append(f.cmds, cmd)
+	if f.reply != nil {
+		return f.reply(cmd, args)
+	}
+	return "OK", nil
+}
+
+func newFakeRedisStore(f *fakeRedis, opts ...eventbus.RedisStoreOption) *eventbus.RedisOffsetStore {
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return f, nil }}
+	return eventbus.NewRedisOffsetStore("app", pool, opts...)
+}
+
+func TestRedisTransactionErrors(t *testing.T) {
+	f := &fakeRedis{reply: func(cmd string, args []interface{}) (interface{}, error) {
+		if cmd == "EXEC" {
+			return []interface{}{int64(1), redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")}, nil
+		}
+		return "OK", nil
+	}}
+	store := newFakeRedisStore(f)
+
+	err := store.SetOffsetWithMeta(0, 10, map[string]string{"server": "srv"})
+	if _, ok := err.(redis.Error); !ok {
+		t.Fatalf("SetOffsetWithMeta() = %v, want the error from the EXEC reply", err)
+	}
+}
+
+func TestRedisIndividualKeys(t *testing.T) {
+	f := &fakeRedis{reply: func(cmd string, args []interface{}) (interface{}, error) {
+		switch cmd {
+		case "EXEC":
+			return []interface{}{"OK", int64(1)}, nil
+		case "SMEMBERS":
+			return []interface{}{[]byte("0"), []byte("3")}, nil
+		case "MGET":
+			// Partition 3 has expired.
+			return []interface{}{[]byte("10"), nil}, nil
+		}
+		return "OK", nil
+	}}
+	store := newFakeRedisStore(f, eventbus.WithRedisKeyScheme(eventbus.RedisIndividualKeys))
+
+	if err := store.SetOffset(0, 10); err != nil {
+		t.Fatalf("SetOffset() = %v", err)
+	}
+	offsets, err := store.GetOffsets()
+	if err != nil {
+		t.Fatalf("GetOffsets() = %v", err)
+	}
+	if want := (eventbus.PartitionOffsets{0: 10}); !reflect.DeepEqual(*offsets, want) {
+		t.Errorf("GetOffsets() = %v, want %v", *offsets, want)
+	}
+	want := []string{"MULTI", "SET", "SADD", "EXEC", "SMEMBERS", "MGET"}
+	if !reflect.DeepEqual(f.cmds, want) {
+		t.Errorf("commands = %q, want %q", f.cmds, want)
+	}
+}
+
+func TestRedisHashTTL(t *testing.T) {
+	var execErr error
+	f := &fakeRedis{reply: func(cmd string, args []interface{}) (interface{}, error) {
+		switch cmd {
+		case "EXEC":
+			if execErr != nil {
+				return []interface{}{int64(1), execErr}, nil
+			}
+			return []interface{}{int64(1)}, nil
+		case "HGETALL":
+			return []interface{}{[]byte("0"), []byte("10"), []byte("1"), []byte("20")}, nil
+		case "ZRANGEBYSCORE":
+			// Partition 1 has not been written for the TTL.
+			return []interface{}{[]byte("0")}, nil
+		}
+		return "OK", nil
+	}}
+	store := newFakeRedisStore(f, eventbus.WithRedisOffsetTTL(time.Minute))
+
+	if err := store.SetOffset(0, 10); err != nil {
+		t.Fatalf("SetOffset() = %v", err)
+	}
+	want := []string{"MULTI", "HSET", "ZADD", "ZREMRANGEBYSCORE", "PEXPIRE", "PEXPIRE", "EXEC"}
+	if !reflect.DeepEqual(f.cmds, want) {
+		t.Errorf("commands = %q, want %q", f.cmds, want)
+	}
+	offsets, err := store.GetOffsets()
+	if err != nil {
+		t.Fatalf("GetOffsets() = %v", err)
+	}
+	if want := (eventbus.PartitionOffsets{0: 10}); !reflect.DeepEqual(*offsets, want) {
+		t.Errorf("GetOffsets() = %v, want the expired partition left out, %v", *offsets, want)
+	}
+
+	execErr = redis.Error("OOM command not allowed")
+	if err := store.SetOffset(0, 11); err != execErr {
+		t.Errorf("SetOffset() = %v, want the error from the EXEC reply", err)
+	}
+}
+
+func TestMultiOffsetStoreReset(t *testing.T) {
+	primary := eventbus.NewInMemoryOffsetStore()
+	fallback := eventbus.NewInMemoryOffsetStore()
+	ms := eventbus.NewMultiOffsetStore(primary, fallback)
+	if err := ms.SetOffset(0, 7); err != nil {
+		t.Fatalf("SetOffset() = %v", err)
+	}
+	if err := ms.ResetOffsets(); err != nil {
+		t.Fatalf("ResetOffsets() = %v", err)
+	}
+	for name, s := range map[string]*eventbus.InMemoryOffsetStore{"primary": primary, "fallback": fallback} {
+		if got := storedOffset(s, 0); got != -1 {
+			t.Errorf("%s offset after reset = %d, want none", name, got)
+		}
+	}
+
+	unresettable := &flakyStore{store: eventbus.NewInMemoryOffsetStore()}
+	ms = eventbus.NewMultiOffsetStore(primary, unresettable)
+	if err := ms.SetOffset(0, 7); err != nil {
+		t.Fatalf("SetOffset() = %v", err)
+	}
+	if err := ms.ResetOffsets(); err != eventbus.ErrResetUnsupported {
+		t.Fatalf("ResetOffsets() with an unresettable store = %v, want ErrResetUnsupported", err)
+	}
+	if got := storedOffset(primary, 0); got != 7 {
+		t.Errorf("primary offset after a refused reset = %d, want 7", got)
+	}
+}
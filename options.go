@@ -0,0 +1,66 @@
+package eventbus
+
+import (
+	"time"
+)
+
+// An Option configures an Eventbus, either when it is created with NewEventbus
+// or while it is running with Reconfigure.
+type Option func(*Eventbus)
+
+// WithReconnectionPolicy sets the policy used to schedule reconnection
+// attempts.
+func WithReconnectionPolicy(p ReconnectionPolicy) Option {
+	return func(eb *Eventbus) {
+		eb.Reconnection = p.NewScheduler()
+	}
+}
+
+// WithKeepAliveTimeout sets how long the connection may go without a frame or
+// ping before it is considered dead.
+func WithKeepAliveTimeout(d time.Duration) Option {
+	return func(eb *Eventbus) {
+		eb.KeepAliveTimeout = d
+	}
+}
+
+// WithFirstConnectImmediate makes the first connection attempt straight away,
+// rather than after the reconnection scheduler's first backoff, to cut startup
+// latency. The scheduler is not consulted for the first attempt, so if it
+// fails the retries back off as they would have from the start. It is off by
+// default.
+func WithFirstConnectImmediate(enabled bool) Option {
+	return func(eb *Eventbus) {
+		eb.firstConnectNow = enabled
+	}
+}
+
+// WithErrorLogger sets the function errors are logged with.
+func WithErrorLogger(el func(e error)) Option {
+	return func(eb *Eventbus) {
+		eb.SetErrorLogger(el)
+	}
+}
+
+// Reconfigure changes the configuration of a running Eventbus without a
+// restart. The options are applied by the run loop, so they never race with
+// it. They are applied once the frame being read, if any, has been handled:
+// the error logger changes from the following frame, while the reconnection
+// policy and keep-alive timeout only take effect on the next connection.
+func (eb *Eventbus) Reconfigure(opts ...Option) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	eb.pendingOptions = append(eb.pendingOptions, opts...)
+}
+
+// applyPendingOptions applies the options queued by Reconfigure, it is only
+// called from the run loop.
+func (eb *Eventbus) applyPendingOptions() {
+	eb.mu.Lock()
+	opts := eb.pendingOptions
+	eb.pendingOptions = nil
+	eb.mu.Unlock()
+	for _, opt := range opts {
+		opt(eb)
+	}
+}
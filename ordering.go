@@ -0,0 +1,41 @@
+package eventbus
+
+import "fmt"
+
+// An OrderingError reports a message delivered at or before the offset of an
+// earlier message on the same partition and connection, see
+// SetStrictOrdering.
+type OrderingError struct {
+	Partition int32
+	Offset    int64
+	Previous  int64
+}
+
+func (e *OrderingError) Error() string {
+	return fmt.Sprintf("out of order delivery on partition %d: offset %d after %d", e.Partition, e.Offset, e.Previous)
+}
+
+// SetStrictOrdering checks that offsets arrive in increasing order within each
+// partition, logging an OrderingError to the error logger for any message that
+// does not, to help track down server or protocol ordering bugs. The message is
+// still handled. Offsets are tracked per connection, so the redelivery of
+// messages after a reconnect is not reported. It is off by default.
+func (eb *Eventbus) SetStrictOrdering(enabled bool) {
+	eb.strictOrdering = enabled
+}
+
+// checkOrdering records the offset of m and reports it if it is not after the
+// last offset seen for its partition.
+func (eb *Eventbus) checkOrdering(m Message) {
+	if !eb.strictOrdering {
+		return
+	}
+	if eb.deliveredOffsets == nil {
+		eb.deliveredOffsets = make(PartitionOffsets)
+	}
+	if last, ok := eb.deliveredOffsets[m.Partition]; ok && m.Offset <= last {
+		eb.logError(&OrderingError{Partition: m.Partition, Offset: m.Offset, Previous: last})
+		return
+	}
+	eb.deliveredOffsets[m.Partition] = m.Offset
+}
@@ -0,0 +1,166 @@
+package eventbus
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// SetPrefetch lets up to depth frames be read from the connection while an
+// earlier message is still being handled, so slow handlers do not hold up
+// network reads. Messages are still handled one at a time and in order, and
+// offsets are committed in order. A depth of zero, the default, reads each
+// frame only once the previous one has been handled.
+// It takes effect from the next connection.
+func (eb *Eventbus) SetPrefetch(depth int) {
+	eb.prefetch = depth
+}
+
+type frame struct {
+	data []byte
+	err  error
+}
+
+// startReader starts reading frames from the connection in the background
+// when prefetching is enabled.
+func (eb *Eventbus) startReader(s socketClient) {
+	if eb.prefetch <= 0 {
+		return
+	}
+	frames := make(chan frame, eb.prefetch)
+	quit := make(chan struct{})
+	eb.frames = frames
+	eb.stopFrames = quit
+	go func() {
+		for {
+			_, msg, err := s.ReadMessage()
+			if err == nil {
+				eb.stats.read(len(msg))
+			}
+			select {
+			case frames <- frame{data: msg, err: err}:
+			case <-quit:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// stopReader discards any prefetched frames, the reader exits once the
+// connection is closed.
+func (eb *Eventbus) stopReader() {
+	if eb.stopFrames != nil {
+		close(eb.stopFrames)
+	}
+	eb.frames = nil
+	eb.stopFrames = nil
+	eb.backlog = nil
+}
+
+// WithLoadShedding makes the client favour fresh messages over complete ones.
+// When more than maxBacklog frames are waiting to be handled, the oldest
+// messages are dropped without being handled and their offsets are committed,
+// so they are never delivered again. It is intended for consumers such as
+// metrics where stale data is worthless, and only has an effect when
+// prefetching is enabled with SetPrefetch. At most the prefetch depth of frames
+// can be waiting, so maxBacklog must be below that depth for any message to be
+// shed.
+func WithLoadShedding(maxBacklog int) Option {
+	return func(eb *Eventbus) {
+		eb.maxBacklog = maxBacklog
+	}
+}
+
+// readFrame returns the next frame from the connection, with its fields
+// renamed to the default frame keys.
+func (eb *Eventbus) readFrame() ([]byte, error) {
+	if eb.frames == nil {
+		msg, err := eb.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		return eb.normalizeFrame(msg), nil
+	}
+	for {
+		data, err := eb.nextPrefetched()
+		if err != nil {
+			return nil, err
+		}
+		if !eb.shouldShed(data) {
+			return data, nil
+		}
+		var meta messageMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return data, nil
+		}
+		if !eb.partitionAllowed(meta.Partition) {
+			continue
+		}
+		if err := eb.commitOffset(meta.Partition, int64(meta.Offset)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// SetLowAllocReads reads each frame into a buffer reused for the next read,
+// rather than allocating a new one, to reduce garbage on high volume
+// streams. Decoded messages do not share the buffer, so handlers are not
+// affected: a body decoded by a custom Unmarshaler is copied out of it. It
+// has no effect when prefetching, as prefetched frames must outlive the next
+// read. It is off by default.
+func (eb *Eventbus) SetLowAllocReads(enabled bool) {
+	eb.lowAllocReads = enabled
+}
+
+// nextReader is implemented by connections that can stream a frame rather
+// than returning it as a new slice, such as *websocket.Conn.
+type nextReader interface {
+	NextReader() (int, io.Reader, error)
+}
+
+// readMessage reads the next frame from the connection. With low-alloc reads
+// the frame is only valid until the next call.
+func (eb *Eventbus) readMessage() ([]byte, error) {
+	r, ok := eb.socket.(nextReader)
+	if !eb.lowAllocReads || !ok {
+		_, msg, err := eb.socket.ReadMessage()
+		if err == nil {
+			eb.stats.read(len(msg))
+		}
+		return msg, err
+	}
+	_, frame, err := r.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	eb.readBuf.Reset()
+	if _, err := eb.readBuf.ReadFrom(frame); err != nil {
+		return nil, err
+	}
+	eb.stats.read(eb.readBuf.Len())
+	return eb.readBuf.Bytes(), nil
+}
+
+// ownBody copies the body of m out of the frame it was decoded from when the
+// frame is in the reused read buffer. Only a custom Unmarshaler can leave the
+// body sharing the frame, json.Unmarshal always copies it.
+func (eb *Eventbus) ownBody(m *Message) {
+	if eb.lowAllocReads && eb.customUnmarshal && m.Body != nil {
+		m.Body = append(json.RawMessage(nil), m.Body...)
+	}
+}
+
+// shouldShed reports whether the frame should be dropped to reduce the
+// backlog. Prioritized backlogs are shed by shedQueued instead, which does
+// not drop the frame chosen to be handled next.
+func (eb *Eventbus) shouldShed(data []byte) bool {
+	if eb.maxBacklog <= 0 || len(eb.partitionPriority) > 0 || len(eb.frames)+len(eb.backlog) <= eb.maxBacklog {
+		return false
+	}
+	if _, ok := eb.state.(streaming); !ok {
+		return false
+	}
+	return isMessageFrame(data)
+}
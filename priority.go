@@ -0,0 +1,130 @@
+package eventbus
+
+import "encoding/json"
+
+// SetPartitionPriority services the messages of higher priority partitions
+// first when frames are backlogged. Partitions not in priorities have priority
+// zero. Of the prefetched frames waiting to be handled, the next message
+// handled is the earliest from the highest priority partition, so messages
+// within a partition are still handled and committed in order. Frames that
+// are not single messages, such as batches and rebalances, are never
+// overtaken.
+//
+// Favouring some partitions can increase the lag of the others, without
+// bound while the high priority partitions stay backlogged. It only has an
+// effect when prefetching is enabled with SetPrefetch, and should be set
+// before Run. With WithLoadShedding, the messages shed are the earliest of the
+// lowest priority partition rather than the oldest overall.
+func (eb *Eventbus) SetPartitionPriority(priorities map[int32]int) {
+	eb.partitionPriority = priorities
+}
+
+// queuedFrame is a prefetched frame waiting to be handled when partitions
+// are prioritized.
+type queuedFrame struct {
+	data      []byte
+	err       error
+	partition int32
+	offset    int64
+	message   bool
+}
+
+// nextPrefetched returns the next prefetched frame to handle, renamed to the
+// default frame keys.
+func (eb *Eventbus) nextPrefetched() ([]byte, error) {
+	if len(eb.partitionPriority) == 0 {
+		f := <-eb.frames
+		if f.err != nil {
+			return nil, f.err
+		}
+		return eb.normalizeFrame(f.data), nil
+	}
+	if len(eb.backlog) == 0 {
+		eb.queueFrame(<-eb.frames)
+	}
+	for more := true; more; {
+		select {
+		case f := <-eb.frames:
+			eb.queueFrame(f)
+		default:
+			more = false
+		}
+	}
+	if err := eb.shedQueued(); err != nil {
+		return nil, err
+	}
+	i := eb.nextQueued()
+	f := eb.backlog[i]
+	eb.backlog = append(eb.backlog[:i], eb.backlog[i+1:]...)
+	return f.data, f.err
+}
+
+func (eb *Eventbus) queueFrame(f frame) {
+	q := queuedFrame{err: f.err}
+	if f.err == nil {
+		q.data = eb.normalizeFrame(f.data)
+		var meta messageMeta
+		if isMessageFrame(q.data) && json.Unmarshal(q.data, &meta) == nil {
+			q.partition = meta.Partition
+			q.offset = int64(meta.Offset)
+			q.message = true
+		}
+	}
+	eb.backlog = append(eb.backlog, q)
+}
+
+// nextQueued returns the index of the earliest queued message from the
+// highest priority partition, among the messages queued before the first
+// frame of any other kind.
+func (eb *Eventbus) nextQueued() int {
+	if _, ok := eb.state.(streaming); !ok {
+		return 0
+	}
+	best := 0
+	for i, f := range eb.backlog {
+		if !f.message {
+			break
+		}
+		if eb.partitionPriority[f.partition] > eb.partitionPriority[eb.backlog[best].partition] {
+			best = i
+		}
+	}
+	return best
+}
+
+// shedQueued drops queued messages while more than maxBacklog frames would
+// still be waiting once the next one is handled, committing their offsets.
+// Each dropped message is the earliest queued from the lowest priority
+// partition, among the messages queued before the first frame of any other
+// kind, so offsets are still committed in order within a partition.
+func (eb *Eventbus) shedQueued() error {
+	if eb.maxBacklog <= 0 {
+		return nil
+	}
+	if _, ok := eb.state.(streaming); !ok {
+		return nil
+	}
+	for len(eb.frames)+len(eb.backlog)-1 > eb.maxBacklog {
+		worst := -1
+		for i, f := range eb.backlog {
+			if !f.message {
+				break
+			}
+			if worst < 0 || eb.partitionPriority[f.partition] < eb.partitionPriority[eb.backlog[worst].partition] {
+				worst = i
+			}
+		}
+		if worst < 0 {
+			return nil
+		}
+		f := eb.backlog[worst]
+		eb.backlog = append(eb.backlog[:worst], eb.backlog[worst+1:]...)
+		if !eb.partitionAllowed(f.partition) {
+			continue
+		}
+		if err := eb.commitOffset(f.partition, f.offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
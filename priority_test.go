@@ -0,0 +1,49 @@
+package eventbus_test
+
+import (
+	"reflect"
+	"testing"
+
+	eventbus "github.com/luzcn6/event-bus"
+)
+
+func TestPrioritizedLoadShedding(t *testing.T) {
+	s := newSession(t,
+		`{"offset":1,"partition":0,"body":{}}`,
+		`{"offset":2,"partition":0,"body":{}}`,
+		`{"offset":3,"partition":0,"body":{}}`,
+		`{"offset":1,"partition":1,"body":{}}`,
+		`{"offset":2,"partition":1,"body":{}}`,
+		`{"status":"alive"}`,
+	)
+	h := &recorder{}
+	store := eventbus.NewInMemoryOffsetStore()
+	eb := newEventbus(t, s.Endpoint(), h, store, eventbus.WithLoadShedding(2))
+	eb.SetPrefetch(8)
+	eb.SetPartitionPriority(map[int32]int{1: 10})
+	// Hold the first message back until every frame, up to the trailing
+	// heartbeat, has been prefetched.
+	eb.SetOnConnect(func() error {
+		waitFor(t, "the frames to be prefetched", func() bool { return eb.ConnStats().FramesRead >= 8 })
+		return nil
+	})
+	run(t, eb)
+
+	waitFor(t, "partition 1 to be committed", func() bool { return storedOffset(store, 1) == 2 })
+	var handled []string
+	h.mu.Lock()
+	for _, m := range h.messages {
+		handled = append(handled, m.String())
+	}
+	h.mu.Unlock()
+	want := []string{
+		"partition=1 offset=1 body=2B",
+		"partition=1 offset=2 body=2B",
+	}
+	if !reflect.DeepEqual(handled, want) {
+		t.Errorf("handled %q, want the low priority messages shed and %q handled", handled, want)
+	}
+	if got := storedOffset(store, 0); got != 3 {
+		t.Errorf("partition 0 stored offset = %d, want the shed offset 3", got)
+	}
+}
@@ -0,0 +1,68 @@
+package eventbus
+
+import "context"
+
+// A NotCommittedReason explains why the offset of a message was not committed,
+// so the message will be delivered again.
+type NotCommittedReason int
+
+const (
+	// HandlerFailed means the handler returned an error.
+	HandlerFailed NotCommittedReason = iota + 1
+	// HandlerPanicked means the handler panicked, ending the run loop.
+	HandlerPanicked
+	// HandlerTimedOut means the handler returned an error for running out of
+	// time, such as ErrAckDeadlineExceeded or context.DeadlineExceeded.
+	HandlerTimedOut
+	// CommitFailed means the message was handled but storing its offset
+	// failed.
+	CommitFailed
+	// MessageSkipped means the message was skipped with a MessageError and
+	// SetCommitSkippedMessages is off.
+	MessageSkipped
+)
+
+func (r NotCommittedReason) String() string {
+	switch r {
+	case HandlerFailed:
+		return "handler failed"
+	case HandlerPanicked:
+		return "handler panicked"
+	case HandlerTimedOut:
+		return "handler timed out"
+	case CommitFailed:
+		return "commit failed"
+	case MessageSkipped:
+		return "message skipped"
+	}
+	return "unknown"
+}
+
+// SetOnNotCommitted sets a callback for each message whose offset is not
+// committed, with the reason and the error behind it, to help diagnose a
+// consumer that keeps redelivering the same message. In at-most-once mode
+// offsets are committed before handling, so only commit failures and skipped
+// messages are reported. Failures to flush batched offsets are reported from
+// the goroutine flushing them, which may not be the run loop.
+func (eb *Eventbus) SetOnNotCommitted(f func(partition int32, offset int64, reason NotCommittedReason, err error)) {
+	eb.onNotCommitted = f
+}
+
+func (eb *Eventbus) notCommitted(partition int32, offset int64, reason NotCommittedReason, err error) {
+	if eb.onNotCommitted != nil {
+		eb.onNotCommitted(partition, offset, reason, err)
+	}
+}
+
+// handlerFailure reports a handler error for m, unless it is a MessageError,
+// which is reported when the message is skipped.
+func (eb *Eventbus) handlerFailure(m Message, err error) {
+	if _, ok := asMessageError(err); ok {
+		return
+	}
+	reason := HandlerFailed
+	if isError(err, ErrAckDeadlineExceeded) || isError(err, context.DeadlineExceeded) {
+		reason = HandlerTimedOut
+	}
+	eb.notCommitted(m.Partition, m.Offset, reason, err)
+}
@@ -3,6 +3,7 @@ package eventbus
 import (
 	"errors"
 	"math"
+	"math/rand"
 	"time"
 )
 
@@ -72,6 +73,10 @@ func (s *exponentialReconnectionScheduler) NextReconnectBackoff() (time.Duration
 	return time.Duration(math.Min(float64(calculateDelay(s.baseDelay, s.attempts)), float64(s.maxDelay))), nil
 }
 
+func (s *exponentialReconnectionScheduler) Reset() {
+	s.attempts = 0
+}
+
 func calculateDelay(base time.Duration, attempts int32) time.Duration {
 	return time.Duration(math.Pow(float64(2), float64(attempts-1))) * base
 }
@@ -85,6 +90,7 @@ type LimitedReconnectionPolicy struct {
 
 type limitedReconnectionScheduler struct {
 	attempts int32
+	limit    int32
 	delay    time.Duration
 }
 
@@ -96,10 +102,14 @@ func (s *limitedReconnectionScheduler) NextReconnectBackoff() (time.Duration, er
 	return s.delay, ErrReconnectsExhausted
 }
 
+func (s *limitedReconnectionScheduler) Reset() {
+	s.attempts = s.limit
+}
+
 // NewScheduler implements the ReconnectionPolicy interface and returns a new
 // limited reconnection scheduler.
 func (p LimitedReconnectionPolicy) NewScheduler() ReconnectionScheduler {
-	return &limitedReconnectionScheduler{p.attempts, p.delay}
+	return &limitedReconnectionScheduler{p.attempts, p.attempts, p.delay}
 }
 
 // NewLimitedReconnectionPolicy creates a new LimitedReconnectionPolicy.
@@ -134,6 +144,10 @@ func (s *limitedExponentialReconnectionScheduler) NextReconnectBackoff() (time.D
 	return s.backoffs[s.attempts-1], nil
 }
 
+func (s *limitedExponentialReconnectionScheduler) Reset() {
+	s.attempts = 0
+}
+
 // LimitedExponentialReconnectionPolicy reconnects with an exponential backoff
 // until the backoff is greater than the maximum delay.
 type LimitedExponentialReconnectionPolicy struct {
@@ -145,3 +159,147 @@ type LimitedExponentialReconnectionPolicy struct {
 func NewLimitedExponentialReconnectionPolicy(base, max time.Duration) *LimitedExponentialReconnectionPolicy {
 	return &LimitedExponentialReconnectionPolicy{base, max}
 }
+
+// FullJitterExponentialReconnectionPolicy reconnects forever with a random
+// delay between zero and an exponentially growing ceiling, capped at maxDelay.
+type FullJitterExponentialReconnectionPolicy struct {
+	baseDelay time.Duration
+	maxDelay  time.Duration
+}
+
+// NewFullJitterExponentialReconnectionPolicy creates a new
+// FullJitterExponentialReconnectionPolicy with the base and max durations.
+func NewFullJitterExponentialReconnectionPolicy(base, max time.Duration) *FullJitterExponentialReconnectionPolicy {
+	return &FullJitterExponentialReconnectionPolicy{base, max}
+}
+
+// NewScheduler implements the ReconnectionPolicy interface and returns a new
+// full jitter exponential reconnection scheduler.
+func (p FullJitterExponentialReconnectionPolicy) NewScheduler() ReconnectionScheduler {
+	return &fullJitterExponentialReconnectionScheduler{
+		baseDelay: p.baseDelay,
+		maxDelay:  p.maxDelay,
+	}
+}
+
+type fullJitterExponentialReconnectionScheduler struct {
+	attempts  int32
+	baseDelay time.Duration
+	maxDelay  time.Duration
+}
+
+func (s *fullJitterExponentialReconnectionScheduler) NextReconnectBackoff() (time.Duration, error) {
+	s.attempts++
+	return jitter(cappedDelay(s.baseDelay, s.maxDelay, s.attempts)), nil
+}
+
+func (s *fullJitterExponentialReconnectionScheduler) Reset() {
+	s.attempts = 0
+}
+
+// cappedDelay is calculateDelay limited to max, computed without overflowing
+// for large attempt counts.
+func cappedDelay(base, max time.Duration, attempts int32) time.Duration {
+	return time.Duration(math.Min(float64(base)*math.Pow(2, float64(attempts-1)), float64(max)))
+}
+
+// jitter returns a random duration in [0, d].
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// ScheduledReconnectionPolicy reconnects with delays taken in turn from a
+// fixed schedule. Once the schedule is used up it either repeats the last delay
+// forever or returns ErrReconnectsExhausted.
+type ScheduledReconnectionPolicy struct {
+	delays     []time.Duration
+	repeatLast bool
+}
+
+// NewScheduledReconnectionPolicy creates a new ScheduledReconnectionPolicy
+// with the delays, repeating the last delay forever if repeatLast is true.
+func NewScheduledReconnectionPolicy(delays []time.Duration, repeatLast bool) *ScheduledReconnectionPolicy {
+	return &ScheduledReconnectionPolicy{append([]time.Duration(nil), delays...), repeatLast}
+}
+
+// NewScheduler implements the ReconnectionPolicy interface and returns a new
+// scheduled reconnection scheduler.
+func (p ScheduledReconnectionPolicy) NewScheduler() ReconnectionScheduler {
+	return &scheduledReconnectionScheduler{
+		delays:     p.delays,
+		repeatLast: p.repeatLast,
+	}
+}
+
+type scheduledReconnectionScheduler struct {
+	attempts   int
+	delays     []time.Duration
+	repeatLast bool
+}
+
+func (s *scheduledReconnectionScheduler) NextReconnectBackoff() (time.Duration, error) {
+	if len(s.delays) == 0 {
+		return 0, ErrReconnectsExhausted
+	}
+	s.attempts++
+	if s.attempts <= len(s.delays) {
+		return s.delays[s.attempts-1], nil
+	}
+	last := s.delays[len(s.delays)-1]
+	if s.repeatLast {
+		return last, nil
+	}
+	return last, ErrReconnectsExhausted
+}
+
+func (s *scheduledReconnectionScheduler) Reset() {
+	s.attempts = 0
+}
+
+// LimitedJitteredExponentialReconnectionPolicy reconnects with full jitter
+// exponential backoff, capped at maxDelay, for a fixed number of attempts and
+// then returns ErrReconnectsExhausted.
+type LimitedJitteredExponentialReconnectionPolicy struct {
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	attempts  int32
+}
+
+// NewLimitedJitteredExponentialReconnectionPolicy creates a new
+// LimitedJitteredExponentialReconnectionPolicy with the base and max durations
+// that gives up after the number of attempts.
+func NewLimitedJitteredExponentialReconnectionPolicy(base, max time.Duration, attempts int32) *LimitedJitteredExponentialReconnectionPolicy {
+	return &LimitedJitteredExponentialReconnectionPolicy{base, max, attempts}
+}
+
+// NewScheduler implements the ReconnectionPolicy interface and returns a new
+// limited jittered exponential reconnection scheduler.
+func (p LimitedJitteredExponentialReconnectionPolicy) NewScheduler() ReconnectionScheduler {
+	return &limitedJitteredExponentialReconnectionScheduler{
+		baseDelay: p.baseDelay,
+		maxDelay:  p.maxDelay,
+		limit:     p.attempts,
+	}
+}
+
+type limitedJitteredExponentialReconnectionScheduler struct {
+	attempts  int32
+	limit     int32
+	baseDelay time.Duration
+	maxDelay  time.Duration
+}
+
+func (s *limitedJitteredExponentialReconnectionScheduler) NextReconnectBackoff() (time.Duration, error) {
+	if s.attempts >= s.limit {
+		return s.maxDelay, ErrReconnectsExhausted
+	}
+	s.attempts++
+	return jitter(cappedDelay(s.baseDelay, s.maxDelay, s.attempts)), nil
+}
+
+func (s *limitedJitteredExponentialReconnectionScheduler) Reset() {
+	s.attempts = 0
+}
@@ -0,0 +1,169 @@
+package eventbus_test
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	eventbus "github.com/luzcn6/event-bus"
+	"github.com/luzcn6/event-bus/eventbustest"
+)
+
+func TestReconnectsExhausted(t *testing.T) {
+	clock := eventbustest.NewFakeClock(time.Unix(0, 0))
+	dialer := &eventbustest.FailingDialer{}
+	eb := eventbus.NewEventbus(eventbus.Config{Endpoint: "ws://eventbus.invalid", Stream: "stream"}, &recorder{}, eventbus.NewInMemoryOffsetStore())
+	eb.SetClock(clock)
+	eb.SetDialer(dialer)
+	eb.SetErrorLogger(nil)
+	eb.Reconnection = eventbus.NewLimitedReconnectionPolicy(3, time.Second).NewScheduler()
+	done := eb.Run()
+
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case err := <-done:
+			if err != eventbus.ErrReconnectsExhausted {
+				t.Fatalf("Run() = %v, want ErrReconnectsExhausted", err)
+			}
+			if n := dialer.Dials(); n != 3 {
+				t.Errorf("Dials() = %d, want 3", n)
+			}
+			if !eb.IsExhausted() {
+				t.Error("IsExhausted() = false after the scheduler gave up")
+			}
+			return
+		case <-deadline:
+			t.Fatalf("Run did not give up, %d dials made", dialer.Dials())
+		case <-time.After(time.Millisecond):
+			if d, ok := clock.NextWake(); ok {
+				clock.Advance(d)
+			}
+		}
+	}
+}
+
+func TestFullJitterExponentialDelays(t *testing.T) {
+	base, max := 100*time.Millisecond, 2*time.Second
+	s := eventbus.NewFullJitterExponentialReconnectionPolicy(base, max).NewScheduler()
+	for attempt := 1; attempt <= 100; attempt++ {
+		d, err := s.NextReconnectBackoff()
+		if err != nil {
+			t.Fatalf("attempt %d: NextReconnectBackoff() error = %v", attempt, err)
+		}
+		ceiling := max
+		if attempt < 6 {
+			ceiling = base << (attempt - 1)
+		}
+		if d < 0 || d > ceiling {
+			t.Errorf("attempt %d: delay %v outside [0, %v]", attempt, d, ceiling)
+		}
+	}
+}
+
+func TestLimitedJitteredExponential(t *testing.T) {
+	base, max := 100*time.Millisecond, time.Second
+	s := eventbus.NewLimitedJitteredExponentialReconnectionPolicy(base, max, 6).NewScheduler()
+	for attempt := 1; attempt <= 6; attempt++ {
+		d, err := s.NextReconnectBackoff()
+		if err != nil {
+			t.Fatalf("attempt %d: NextReconnectBackoff() error = %v", attempt, err)
+		}
+		ceiling := max
+		if attempt < 5 {
+			ceiling = base << (attempt - 1)
+		}
+		if d < 0 || d > ceiling {
+			t.Errorf("attempt %d: delay %v outside [0, %v]", attempt, d, ceiling)
+		}
+	}
+	if _, err := s.NextReconnectBackoff(); err != eventbus.ErrReconnectsExhausted {
+		t.Errorf("attempt 7: NextReconnectBackoff() error = %v, want ErrReconnectsExhausted", err)
+	}
+	s.(eventbus.ResettableScheduler).Reset()
+	if _, err := s.NextReconnectBackoff(); err != nil {
+		t.Errorf("after Reset: NextReconnectBackoff() error = %v", err)
+	}
+}
+
+// failFirstWriteDialer dials with websocket.DefaultDialer, making writes to the
+// first connection fail.
+type failFirstWriteDialer struct {
+	mu    sync.Mutex
+	dials int
+}
+
+func (d *failFirstWriteDialer) Dial(url string, h http.Header) (*websocket.Conn, *http.Response, error) {
+	c, resp, err := websocket.DefaultDialer.Dial(url, h)
+	if err != nil {
+		return nil, resp, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials++
+	if d.dials == 1 {
+		c.SetWriteDeadline(time.Now().Add(-time.Second))
+	}
+	return c, resp, nil
+}
+
+func (d *failFirstWriteDialer) Dials() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials
+}
+
+func TestHandshakeWriteRetried(t *testing.T) {
+	s := newSession(t, `{"offset":1,"partition":0,"body":{}}`)
+	h := &recorder{}
+	store := eventbus.NewInMemoryOffsetStore()
+	dialer := &failFirstWriteDialer{}
+	eb := newEventbus(t, s.Endpoint(), h, store)
+	eb.SetDialer(dialer)
+	eb.SetHandshakeRetries(1, 0)
+	// The first dial is immediate, the retry must not wait for the reconnection
+	// policy's next backoff.
+	eb.Reconnection = eventbus.NewScheduledReconnectionPolicy([]time.Duration{0, time.Hour}, true).NewScheduler()
+	run(t, eb)
+
+	waitFor(t, "offset 1 to be committed", func() bool { return storedOffset(store, 0) == 1 })
+	if n := dialer.Dials(); n != 2 {
+		t.Errorf("Dials() = %d, want 2", n)
+	}
+}
+
+func TestFirstConnectImmediate(t *testing.T) {
+	for _, immediate := range []bool{true, false} {
+		name := "immediate"
+		if !immediate {
+			name = "after backoff"
+		}
+		t.Run(name, func(t *testing.T) {
+			clock := eventbustest.NewFakeClock(time.Unix(0, 0))
+			dialer := &eventbustest.FailingDialer{}
+			eb := eventbus.NewEventbus(eventbus.Config{Endpoint: "ws://eventbus.invalid", Stream: "stream"}, &recorder{}, eventbus.NewInMemoryOffsetStore(),
+				eventbus.WithFirstConnectImmediate(immediate))
+			eb.SetClock(clock)
+			eb.SetDialer(dialer)
+			eb.SetErrorLogger(nil)
+			eb.Reconnection = eventbus.NewConstantReconnectionPolicy(time.Second).NewScheduler()
+			run(t, eb)
+
+			// Either way the loop ends up waiting on the clock: before the first
+			// dial, or before the retry after it.
+			waitFor(t, "the loop to wait on the clock", func() bool {
+				_, ok := clock.NextWake()
+				return ok
+			})
+			want := 0
+			if immediate {
+				want = 1
+			}
+			if n := dialer.Dials(); n != want {
+				t.Errorf("Dials() before the clock advanced = %d, want %d", n, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package eventbus
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// A PoolOption configures the pool created by NewRedisPool.
+type PoolOption func(*poolConfig)
+
+type poolConfig struct {
+	maxIdle     int
+	maxActive   int
+	idleTimeout time.Duration
+	dialOptions []redis.DialOption
+}
+
+// WithPoolMaxIdle sets the maximum number of idle connections kept in the pool.
+// The default is 3.
+func WithPoolMaxIdle(n int) PoolOption {
+	return func(c *poolConfig) {
+		c.maxIdle = n
+	}
+}
+
+// WithPoolMaxActive limits the number of connections open at once, zero means
+// no limit, which is the default.
+func WithPoolMaxActive(n int) PoolOption {
+	return func(c *poolConfig) {
+		c.maxActive = n
+	}
+}
+
+// WithPoolIdleTimeout closes connections that have been idle for longer than
+// d. The default is four minutes, below the idle timeout of most Redis hosts.
+func WithPoolIdleTimeout(d time.Duration) PoolOption {
+	return func(c *poolConfig) {
+		c.idleTimeout = d
+	}
+}
+
+// WithPoolDialOptions passes opts to redis.Dial for each new connection, for
+// example to set a password or timeouts.
+func WithPoolDialOptions(opts ...redis.DialOption) PoolOption {
+	return func(c *poolConfig) {
+		c.dialOptions = append(c.dialOptions, opts...)
+	}
+}
+
+// NewRedisPool creates a redis.Pool connecting to addr over TCP, suitable for
+// NewRedisOffsetStore. Connections that have been idle for over a minute are
+// checked with a PING before being handed out, so connections dropped by the
+// server are discarded rather than failing a commit.
+func NewRedisPool(addr string, opts ...PoolOption) *redis.Pool {
+	c := poolConfig{
+		maxIdle:     3,
+		idleTimeout: 4 * time.Minute,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return &redis.Pool{
+		MaxIdle:     c.maxIdle,
+		MaxActive:   c.maxActive,
+		IdleTimeout: c.idleTimeout,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr, c.dialOptions...)
+		},
+		TestOnBorrow: func(conn redis.Conn, idleSince time.Time) error {
+			if time.Since(idleSince) < time.Minute {
+				return nil
+			}
+			_, err := conn.Do("PING")
+			return err
+		},
+	}
+}
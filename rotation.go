@@ -0,0 +1,50 @@
+package eventbus
+
+import "time"
+
+// WithMaxConnectionAge rotates connections once they have been open for d,
+// even when healthy, for load balancers that only spread connections across
+// server instances as they are made. Rotation is a planned reconnect, as with
+// Resubscribe: the message being handled finishes first, pending offsets are
+// flushed, the reconnection backoff is reset and a new connection is made
+// straight away. Frames read ahead with SetPrefetch but not yet handled are
+// not committed, so they are delivered again on the new connection. A zero
+// age, the default, never rotates.
+func WithMaxConnectionAge(d time.Duration) Option {
+	return func(eb *Eventbus) {
+		eb.maxConnectionAge = d
+	}
+}
+
+// startRotation arranges for the connection to be rotated once it reaches
+// the maximum age.
+func (eb *Eventbus) startRotation(socket socketClient) {
+	if eb.maxConnectionAge <= 0 || eb.stopRotating != nil {
+		return
+	}
+	age := eb.maxConnectionAge
+	quit := make(chan struct{})
+	eb.stopRotating = quit
+	go func() {
+		select {
+		case <-eb.clock.After(age):
+		case <-quit:
+			return
+		}
+		eb.mu.Lock()
+		current := eb.socket == socket
+		eb.mu.Unlock()
+		if current {
+			eb.debugf("rotating connection after %s", age)
+			eb.requestReconnect()
+		}
+	}()
+}
+
+// stopRotation cancels the rotation of the current connection.
+func (eb *Eventbus) stopRotation() {
+	if eb.stopRotating != nil {
+		close(eb.stopRotating)
+		eb.stopRotating = nil
+	}
+}
@@ -0,0 +1,136 @@
+package eventbus
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Flush writes any offsets held back by SetCommitInterval to the store now.
+// Offsets that cannot be written stay pending and the first error is returned.
+func (eb *Eventbus) Flush() error {
+	return eb.flushOffsets()
+}
+
+// Stop shuts the run loop down once the message being handled, if any, has
+// finished, discarding any frames read ahead with SetPrefetch. Pending offsets
+// are flushed as the loop exits, then the offset store is closed if it
+// implements io.Closer, and Stop returns any error flushing offsets or closing
+// the store. The store is only closed once, by the first Stop or Drain after
+// Run, so a Stop before Run leaves it open.
+// It blocks until the loop has exited, so must not be called from a handler.
+func (eb *Eventbus) Stop() error {
+	eb.requestStop(false)
+	return eb.awaitStop()
+}
+
+// Drain is like Stop, but first handles the frames already read ahead with
+// SetPrefetch. No further frames are read from the connection.
+func (eb *Eventbus) Drain() error {
+	eb.requestStop(true)
+	return eb.awaitStop()
+}
+
+// RunUntilSignal runs the eventbus loop on the calling goroutine until one of
+// the signals is received, os.Interrupt or SIGTERM if none are given, and then
+// drains and returns. Pending offsets are flushed and the offset store closed
+// as Stop does, whether the loop stopped or failed. It returns the terminal
+// error if the loop fails first, or any error flushing offsets or closing the
+// store.
+func (eb *Eventbus) RunUntilSignal(sig ...os.Signal) error {
+	if len(sig) == 0 {
+		sig = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sig...)
+	defer signal.Stop(signals)
+
+	returned := make(chan struct{})
+	defer close(returned)
+	go func() {
+		select {
+		case <-signals:
+			eb.requestStop(true)
+		case <-returned:
+		}
+	}()
+	err := eb.RunBlocking(context.Background())
+	if err == ErrAlreadyRunning {
+		return err
+	}
+	if serr := eb.awaitStop(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// requestStop tells the run loop to exit and closes the connection so that a
+// blocked read returns. A Stop after a Drain stops without draining.
+func (eb *Eventbus) requestStop(drain bool) {
+	eb.mu.Lock()
+	if !eb.stopping || !drain {
+		eb.draining = drain
+	}
+	eb.stopping = true
+	socket := eb.socket
+	eb.mu.Unlock()
+	eb.stopOnce.Do(func() {
+		close(eb.stop)
+	})
+	if socket != nil {
+		socket.Close()
+	}
+}
+
+func (eb *Eventbus) awaitStop() error {
+	eb.mu.Lock()
+	started := eb.started
+	eb.mu.Unlock()
+	if started {
+		<-eb.exited
+	}
+	err := eb.Flush()
+	if closer, ok := eb.store.(io.Closer); ok && started {
+		eb.closeOnce.Do(func() {
+			if cerr := closer.Close(); err == nil {
+				err = cerr
+			}
+		})
+	}
+	return err
+}
+
+// stopState reports whether a stop has been requested, and if so whether the
+// prefetched frames should be handled first.
+func (eb *Eventbus) stopState() (stopping, draining bool) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	return eb.stopping, eb.draining
+}
+
+// startFlushTicker flushes batched offsets every commit interval, so that
+// they are written even when no further messages arrive. The returned func
+// stops the ticker.
+func (eb *Eventbus) startFlushTicker() func() {
+	if eb.commitInterval <= 0 {
+		return func() {}
+	}
+	quit := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-eb.clock.After(eb.commitInterval):
+			case <-quit:
+				return
+			}
+			if err := eb.flushOffsets(); err != nil {
+				eb.logError(err)
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build linux || darwin
+
+package eventbus_test
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	eventbus "github.com/luzcn6/event-bus"
+)
+
+func TestRunUntilSignalClosesStore(t *testing.T) {
+	s := newSession(t)
+	store := &closingStore{InMemoryOffsetStore: eventbus.NewInMemoryOffsetStore()}
+	eb := eventbus.NewEventbus(eventbus.Config{Endpoint: s.Endpoint(), Stream: "stream"}, &recorder{}, store)
+	eb.Reconnection = eventbus.NewConstantReconnectionPolicy(0).NewScheduler()
+	done := make(chan error, 1)
+	go func() {
+		done <- eb.RunUntilSignal(syscall.SIGUSR1)
+	}()
+	s.handshake(t)
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("RunUntilSignal() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunUntilSignal did not return after the signal")
+	}
+	if n := store.closes(); n != 1 {
+		t.Errorf("store closed %d times, want 1", n)
+	}
+}
@@ -0,0 +1,182 @@
+package eventbus_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	eventbus "github.com/luzcn6/event-bus"
+)
+
+// closingStore is an InMemoryOffsetStore that counts the calls to Close.
+type closingStore struct {
+	*eventbus.InMemoryOffsetStore
+	mu     sync.Mutex
+	closed int
+}
+
+func (s *closingStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed++
+	return nil
+}
+
+func (s *closingStore) closes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func TestStopClosesStoreOnce(t *testing.T) {
+	s := newSession(t)
+	store := &closingStore{InMemoryOffsetStore: eventbus.NewInMemoryOffsetStore()}
+	eb := eventbus.NewEventbus(eventbus.Config{Endpoint: s.Endpoint(), Stream: "stream"}, &recorder{}, store)
+	eb.Reconnection = eventbus.NewConstantReconnectionPolicy(0).NewScheduler()
+	eb.Run()
+	s.handshake(t)
+
+	if err := eb.Stop(); err != nil {
+		t.Fatalf("Stop() = %v", err)
+	}
+	if err := eb.Stop(); err != nil {
+		t.Fatalf("second Stop() = %v", err)
+	}
+	if n := store.closes(); n != 1 {
+		t.Errorf("store closed %d times, want 1", n)
+	}
+}
+
+func TestRunBlockingContextClosesStore(t *testing.T) {
+	s := newSession(t)
+	store := &closingStore{InMemoryOffsetStore: eventbus.NewInMemoryOffsetStore()}
+	eb := eventbus.NewEventbus(eventbus.Config{Endpoint: s.Endpoint(), Stream: "stream"}, &recorder{}, store)
+	eb.Reconnection = eventbus.NewConstantReconnectionPolicy(0).NewScheduler()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	returned := make(chan error, 1)
+	go func() {
+		returned <- eb.RunBlocking(ctx)
+	}()
+	s.handshake(t)
+
+	cancel()
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatalf("RunBlocking() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunBlocking did not return when the context was cancelled")
+	}
+	if n := store.closes(); n != 1 {
+		t.Errorf("store closed %d times, want 1", n)
+	}
+}
+
+func TestStopBeforeRunLeavesStoreOpen(t *testing.T) {
+	store := &closingStore{InMemoryOffsetStore: eventbus.NewInMemoryOffsetStore()}
+	eb := eventbus.NewEventbus(eventbus.Config{Endpoint: "ws://127.0.0.1:1", Stream: "stream"}, &recorder{}, store)
+
+	if err := eb.Stop(); err != nil {
+		t.Fatalf("Stop() = %v", err)
+	}
+	if n := store.closes(); n != 0 {
+		t.Errorf("store closed %d times before Run, want 0", n)
+	}
+}
+
+func TestPanicFlushesPendingOffsets(t *testing.T) {
+	s := newSession(t,
+		`{"offset":1,"partition":0,"body":{}}`,
+		`{"offset":2,"partition":0,"body":{}}`,
+		`{"offset":3,"partition":0,"body":{}}`,
+	)
+	h := &recorder{fail: func(m eventbus.Message) error {
+		if m.Offset == 3 {
+			panic("handler bug")
+		}
+		return nil
+	}}
+	store := eventbus.NewInMemoryOffsetStore()
+	eb := newEventbus(t, s.Endpoint(), h, store)
+	eb.SetCommitInterval(time.Hour)
+	done := run(t, eb)
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Run() = nil, want the panic")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the panic did not stop the loop")
+	}
+	if got := storedOffset(store, 0); got != 2 {
+		t.Errorf("stored offset = %d, want the pending offset 2 flushed", got)
+	}
+}
+
+func TestShutdownRoutesFlush(t *testing.T) {
+	tests := []struct {
+		name     string
+		shutdown func(t *testing.T, eb *eventbus.Eventbus, cancel context.CancelFunc)
+	}{
+		{"Stop", func(t *testing.T, eb *eventbus.Eventbus, _ context.CancelFunc) {
+			if err := eb.Stop(); err != nil {
+				t.Fatalf("Stop() = %v", err)
+			}
+		}},
+		{"Drain", func(t *testing.T, eb *eventbus.Eventbus, _ context.CancelFunc) {
+			if err := eb.Drain(); err != nil {
+				t.Fatalf("Drain() = %v", err)
+			}
+		}},
+		{"context", func(t *testing.T, eb *eventbus.Eventbus, cancel context.CancelFunc) {
+			cancel()
+		}},
+		{"Flush", func(t *testing.T, eb *eventbus.Eventbus, _ context.CancelFunc) {
+			if err := eb.Flush(); err != nil {
+				t.Fatalf("Flush() = %v", err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSession(t,
+				`{"offset":1,"partition":0,"body":{}}`,
+				`{"offset":2,"partition":0,"body":{}}`,
+				`{"offset":3,"partition":0,"body":{}}`,
+			)
+			h := &recorder{}
+			store := eventbus.NewInMemoryOffsetStore()
+			eb := newEventbus(t, s.Endpoint(), h, store)
+			eb.SetCommitInterval(time.Hour)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			returned := make(chan error, 1)
+			go func() {
+				returned <- eb.RunBlocking(ctx)
+			}()
+			t.Cleanup(func() { eb.Stop() })
+
+			// Offset 2 is committed before offset 3 is read, and held back
+			// by the interval, while the first commit is written at once.
+			waitFor(t, "offset 3 to be handled", func() bool { return len(h.offsets()) == 3 })
+			if got := storedOffset(store, 0); got != 1 {
+				t.Fatalf("stored offset before shutdown = %d, want 1", got)
+			}
+			tt.shutdown(t, eb, cancel)
+			if tt.name == "context" {
+				select {
+				case <-returned:
+				case <-time.After(5 * time.Second):
+					t.Fatal("RunBlocking did not return when the context was cancelled")
+				}
+			}
+			if got := storedOffset(store, 0); got < 2 {
+				t.Errorf("stored offset after %s = %d, want the pending offsets flushed", tt.name, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package eventbus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrSnapshotStream is returned by Restore for a snapshot taken from a
+// different stream.
+var ErrSnapshotStream = errors.New("snapshot is for a different stream")
+
+// snapshotVersion is the version of the snapshot format written by Snapshot.
+const snapshotVersion = 1
+
+// snapshot is the serialized form of the consumer position.
+type snapshot struct {
+	Version        int             `json:"version"`
+	Stream         string          `json:"stream,omitempty"`
+	StartingOffset int64           `json:"starting_offset"`
+	Offsets        map[int32]int64 `json:"offsets,omitempty"`
+}
+
+// Snapshot returns the consumer position as a portable blob to pass to Restore
+// in another process, to hand off consumption when the offset store is not
+// shared, such as during a blue/green deploy. Pending offsets are flushed
+// first, and the snapshot holds the offsets in the store along with the
+// starting offset. Stop the Eventbus first so no further offsets are
+// committed after the snapshot is taken.
+func (eb *Eventbus) Snapshot() ([]byte, error) {
+	if err := eb.Flush(); err != nil {
+		return nil, err
+	}
+	offsets, err := eb.store.GetOffsets()
+	if err != nil {
+		return nil, err
+	}
+	eb.mu.Lock()
+	s := snapshot{
+		Version:        snapshotVersion,
+		Stream:         eb.config.Stream,
+		StartingOffset: eb.startingOffset,
+	}
+	eb.mu.Unlock()
+	if offsets != nil {
+		s.Offsets = *offsets
+	}
+	return json.Marshal(s)
+}
+
+// Restore writes the offsets in a blob returned by Snapshot to the offset
+// store and sets the starting offset, so the Eventbus resumes where the
+// snapshotted one stopped. It should be called before Run; offsets restored
+// while running are used from the next connection. It returns
+// ErrSnapshotStream if the snapshot was taken from another stream.
+func (eb *Eventbus) Restore(data []byte) error {
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("decoding snapshot: %w", err)
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+	if s.Stream != "" && eb.config.Stream != "" && s.Stream != eb.config.Stream {
+		return fmt.Errorf("%w: %q", ErrSnapshotStream, s.Stream)
+	}
+	if err := eb.StartAtOffset(s.StartingOffset); err != nil {
+		return err
+	}
+	eb.commitMu.Lock()
+	defer eb.commitMu.Unlock()
+	for partition, offset := range s.Offsets {
+		if err := eb.store.SetOffset(partition, offset); err != nil {
+			return &CommitError{Partition: partition, Offset: offset, Err: err}
+		}
+		if eb.committedOffsets == nil {
+			eb.committedOffsets = make(PartitionOffsets)
+		}
+		eb.committedOffsets[partition] = offset
+	}
+	return nil
+}
@@ -2,38 +2,66 @@ package eventbus
 
 import (
 	"encoding/json"
+	"fmt"
+	"strconv"
 
 	"github.com/pkg/errors"
 )
 
+// ErrInvalidBody is returned when body validation is enabled and a message has
+// a missing, null or malformed body.
+var ErrInvalidBody = errors.New("invalid message body")
+
+// ErrIncompleteFrame is logged for a frame that has an offset but no
+// partition, or a partition but no offset. The frame is skipped, as it can
+// neither be handled nor committed.
+var ErrIncompleteFrame = errors.New("frame has only one of offset and partition")
+
+// The names of the states returned by Eventbus.State.
+const (
+	StateDisconnected = "disconnected"
+	StateConnecting   = "connecting"
+	StateReady        = "ready"
+	StateStreaming    = "streaming"
+)
+
 type eventbusState interface {
+	fmt.Stringer
 	handleEvent(*Eventbus, []byte) error
 }
 
 type serverHandshake struct {
-	ID     string `json:"id"`
-	Status string `json:"status"`
+	ID           string   `json:"id"`
+	Status       string   `json:"status"`
+	Version      string   `json:"version"`
+	Capabilities []string `json:"capabilities"`
 }
 
 type connecting struct{}
 
+func (s connecting) String() string {
+	return StateConnecting
+}
+
 func (s connecting) handleEvent(eventbus *Eventbus, body []byte) error {
 	var sh serverHandshake
 	err := json.Unmarshal(body, &sh)
 	if err != nil {
 		return errors.Wrap(err, "unmarshalling body in connecting.handleEvent")
 	}
+	eventbus.serverID = sh.ID
+	eventbus.setServerInfo(sh.Version, sh.Capabilities)
 
-	handshake := eventbus.createHandshake(sh.ID)
-	response, err := json.Marshal(handshake)
+	response, err := eventbus.handshakeBytes(sh.ID)
 	if err != nil {
-		return errors.Wrap(err, "marshalling response in connecting.handleEvent")
+		return errors.Wrap(err, "creating handshake in connecting.handleEvent")
 	}
 
 	err = eventbus.sendBytes(response)
 	if err != nil {
-		return errors.Wrap(err, "sending handshake in connecting.handleEvent")
+		return errors.Wrap(&handshakeSendError{err: err}, "sending handshake in connecting.handleEvent")
 	}
+	eventbus.handshakeFailures = 0
 	eventbus.setState(ready{})
 	return nil
 }
@@ -44,39 +72,313 @@ type streamingEvent struct {
 	Stream string `json:"stream"`
 }
 
+// framePeek records which fields are present in a frame, it is decoded once
+// per frame to tell messages from control frames.
+type framePeek struct {
+	Offset    *json.RawMessage `json:"offset"`
+	Partition *json.RawMessage `json:"partition"`
+	Assigned  *json.RawMessage `json:"assigned"`
+	Revoked   *json.RawMessage `json:"revoked"`
+}
+
+// peekFrame decodes the fields present in the frame, it reports false if the
+// frame is not a JSON object.
+func peekFrame(body []byte) (framePeek, bool) {
+	var p framePeek
+	if err := json.Unmarshal(body, &p); err != nil {
+		return framePeek{}, false
+	}
+	return p, true
+}
+
+// isMessage reports whether the frame carries a message.
+func (p framePeek) isMessage() bool {
+	return p.Offset != nil && p.Partition != nil
+}
+
+// isHeartbeat reports whether the frame carries neither an offset nor a
+// partition, such as a heartbeat or status frame sent while streaming.
+func (p framePeek) isHeartbeat() bool {
+	return p.Offset == nil && p.Partition == nil
+}
+
+// isRebalance reports whether the frame changes the partitions assigned to a
+// consumer group member.
+func (p framePeek) isRebalance() bool {
+	return p.Assigned != nil || p.Revoked != nil
+}
+
+// isMessageFrame reports whether the frame carries a message, rather than
+// being a control frame such as the ready signal.
+func isMessageFrame(body []byte) bool {
+	p, ok := peekFrame(body)
+	return ok && p.isMessage()
+}
+
 type ready struct{}
 
+func (s ready) String() string {
+	return StateReady
+}
+
 func (s ready) handleEvent(eventbus *Eventbus, body []byte) error {
+	if isMessageFrame(body) || isBatchFrame(body) {
+		// The server started streaming without a separate ready frame, so
+		// this frame is the first message.
+		if err := eventbus.callOnConnect(); err != nil {
+			return errors.Wrap(err, "calling on connect hook in ready.handleEvent")
+		}
+		eventbus.startStreaming()
+		return streaming{}.handleEvent(eventbus, body)
+	}
 	var sm streamingEvent
 	err := json.Unmarshal(body, &sm)
 	if err != nil {
 		return errors.Wrap(err, "unmarshalling body in ready.handleEvent")
 	}
-	eventbus.setState(streaming{})
+	if err := eventbus.callOnConnect(); err != nil {
+		return errors.Wrap(err, "calling on connect hook in ready.handleEvent")
+	}
+	eventbus.startStreaming()
 	return nil
 }
 
 type streaming struct{}
 
+func (s streaming) String() string {
+	return StateStreaming
+}
+
 type Message struct {
 	Offset    int64           `json:"offset"`
 	Partition int32           `json:"partition"`
 	Body      json.RawMessage `json:"body"`
+	// Stream is the stream the message was published to, when the frame
+	// includes it.
+	Stream string `json:"stream,omitempty"`
+	// Headers carries metadata such as correlation or trace IDs when the frame
+	// includes a headers object, it is nil otherwise.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// String describes the message for logging, the body is summarised by its
+// length.
+func (m Message) String() string {
+	return fmt.Sprintf("partition=%d offset=%d body=%dB", m.Partition, m.Offset, len(m.Body))
+}
+
+// messageFrame is the wire form of a Message. It is decoded with the
+// configured unmarshaler and converted, so Message keeps the default JSON
+// decoding.
+type messageFrame struct {
+	Offset    frameOffset       `json:"offset"`
+	Partition int32             `json:"partition"`
+	Body      json.RawMessage   `json:"body"`
+	Stream    string            `json:"stream,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+}
+
+func (f messageFrame) message() Message {
+	return Message{
+		Offset:    int64(f.Offset),
+		Partition: f.Partition,
+		Body:      f.Body,
+		Stream:    f.Stream,
+		Headers:   f.Headers,
+	}
+}
+
+// messageMeta is the part of a message frame that can be decoded without
+// retaining the body.
+type messageMeta struct {
+	Offset    frameOffset `json:"offset"`
+	Partition int32       `json:"partition"`
+	Stream    string      `json:"stream"`
+}
+
+// frameOffset is an offset in a message frame. It may be a JSON number or a
+// string holding one, as servers that pass offsets through JavaScript send
+// offsets beyond 2^53 as strings to keep them exact. Either way it is parsed
+// directly as an int64, never through a float64.
+type frameOffset int64
+
+// UnmarshalJSON decodes the offset, null leaves it unchanged.
+func (o *frameOffset) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if len(s) > 1 && s[0] == '"' {
+		unquoted, err := strconv.Unquote(s)
+		if err != nil {
+			return errors.Wrapf(err, "parsing offset %s", s)
+		}
+		s = unquoted
+	}
+	offset, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "parsing offset %q", s)
+	}
+	*o = frameOffset(offset)
+	return nil
 }
 
 func (s streaming) handleEvent(eventbus *Eventbus, body []byte) error {
-	var m Message
-	err := json.Unmarshal(body, &m)
+	if isBatchFrame(body) {
+		if eventbus.batch != nil {
+			return errors.New("nested batch in streaming.handleEvent")
+		}
+		return s.handleBatch(eventbus, body)
+	}
+	// Frames that are not JSON objects fall through to the decode below, which
+	// reports them.
+	if p, ok := peekFrame(body); ok {
+		switch {
+		case eventbus.config.ConsumerGroup != "" && p.isRebalance():
+			return eventbus.handleRebalance(p)
+		case p.isHeartbeat():
+			return nil
+		case !p.isMessage():
+			eventbus.logError(ErrIncompleteFrame)
+			return nil
+		}
+	}
+	if eventbus.metaFilter != nil || eventbus.hasPartitionAllowlist() {
+		var meta messageMeta
+		err := eventbus.unmarshal(body, &meta)
+		if err != nil {
+			return errors.Wrap(err, "unmarshalling metadata in streaming.handleEvent")
+		}
+		if !eventbus.partitionAllowed(meta.Partition) {
+			return nil
+		}
+		if eventbus.metaFilter != nil && !eventbus.metaFilter(meta.Partition, int64(meta.Offset), meta.Stream) {
+			err = eventbus.commitMessage(meta.Partition, int64(meta.Offset))
+			if err != nil {
+				return errors.Wrap(err, "storing offset in streaming.handleEvent")
+			}
+			return nil
+		}
+	}
+	if eventbus.rawHandler != nil {
+		var meta messageMeta
+		err := eventbus.unmarshal(body, &meta)
+		if err != nil {
+			return errors.Wrap(err, "unmarshalling metadata in streaming.handleEvent")
+		}
+		if eventbus.rawHandlerFor(meta.Partition) {
+			eventbus.rawFrame = body
+			defer func() { eventbus.rawFrame = nil }()
+			return s.dispatch(eventbus, Message{Offset: int64(meta.Offset), Partition: meta.Partition, Stream: meta.Stream})
+		}
+	}
+	var f messageFrame
+	err := eventbus.unmarshal(body, &f)
 	if err != nil {
+		var meta messageMeta
+		if json.Unmarshal(body, &meta) == nil {
+			err = &MessageError{Partition: meta.Partition, Offset: int64(meta.Offset), Err: err}
+		}
 		return errors.Wrap(err, "unmarshalling body in streaming.handleEvent")
 	}
-	err = eventbus.eventHandler.Handle(m)
-	if err != nil {
-		return errors.Wrap(err, "handling event in streaming.handleEvent")
+	m := f.message()
+	eventbus.ownBody(&m)
+	if eventbus.validateBodies && !validBody(m.Body) {
+		return errors.Wrap(&MessageError{Partition: m.Partition, Offset: m.Offset, Err: ErrInvalidBody}, "validating body in streaming.handleEvent")
+	}
+	return s.dispatch(eventbus, m)
+}
+
+// dispatch passes the message to its handler and commits the offset according
+// to the delivery mode.
+func (s streaming) dispatch(eventbus *Eventbus, m Message) error {
+	eventbus.checkOrdering(m)
+	defer eventbus.beginHandling()()
+	key, hasKey, dup := eventbus.duplicateKey(m)
+	if dup {
+		err := eventbus.commitMessage(m.Partition, m.Offset)
+		if err != nil {
+			return errors.Wrap(err, "storing offset in streaming.dispatch")
+		}
+		return nil
+	}
+	if eventbus.txHandler != nil {
+		commit := func() error {
+			return eventbus.commitOffset(m.Partition, m.Offset)
+		}
+		eventbus.inFlight = &m
+		err := eventbus.txHandler.HandleTx(m, commit)
+		eventbus.inFlight = nil
+		out, err := handlerOutcome(err)
+		eventbus.recordHandlerResult(err)
+		if err != nil {
+			eventbus.handlerFailure(m, err)
+		}
+		if limit := eventbus.checkHandlerErrorLimit(m, err); limit != nil {
+			return limit
+		}
+		if err != nil {
+			return errors.Wrap(err, "handling event in streaming.dispatch")
+		}
+		if out == skipped {
+			return nil
+		}
+		eventbus.markHandled(m)
+		if hasKey {
+			eventbus.dedupe.add(key)
+		}
+		eventbus.observeFirstMessage()
+		if out == dropped {
+			err = eventbus.commitMessage(m.Partition, m.Offset)
+			if err != nil {
+				return errors.Wrap(err, "storing offset in streaming.dispatch")
+			}
+		}
+		return nil
+	}
+	if eventbus.deliveryMode == AtMostOnce {
+		err := eventbus.commitMessage(m.Partition, m.Offset)
+		if err != nil {
+			return errors.Wrap(err, "storing offset in streaming.dispatch")
+		}
+	}
+	eventbus.inFlight = &m
+	err := eventbus.handle(m)
+	eventbus.inFlight = nil
+	out, err := handlerOutcome(err)
+	eventbus.recordHandlerResult(err)
+	if err != nil && eventbus.deliveryMode == AtLeastOnce {
+		eventbus.handlerFailure(m, err)
+	}
+	if limit := eventbus.checkHandlerErrorLimit(m, err); limit != nil {
+		return limit
+	}
+	if err != nil && eventbus.deliveryMode == AtMostOnce {
+		// The offset is already committed, so recycling the connection would
+		// not deliver the message again.
+		eventbus.logError(errors.Wrap(err, "handling event in streaming.dispatch"))
+		return nil
 	}
-	err = eventbus.store.SetOffset(m.Partition, m.Offset)
 	if err != nil {
-		return errors.Wrap(err, "storing offset in streaming.handleEvent")
+		return errors.Wrap(err, "handling event in streaming.dispatch")
+	}
+	if out == skipped {
+		return nil
+	}
+	eventbus.markHandled(m)
+	if hasKey {
+		eventbus.dedupe.add(key)
+	}
+	eventbus.observeFirstMessage()
+	if eventbus.deliveryMode == AtLeastOnce {
+		err = eventbus.commitMessage(m.Partition, m.Offset)
+		if err != nil {
+			return errors.Wrap(err, "storing offset in streaming.dispatch")
+		}
 	}
 	return nil
 }
+
+func validBody(body json.RawMessage) bool {
+	return len(body) > 0 && string(body) != "null" && json.Valid(body)
+}
@@ -0,0 +1,149 @@
+package eventbus_test
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	eventbus "github.com/luzcn6/event-bus"
+	"github.com/luzcn6/event-bus/eventbustest"
+)
+
+func TestStreamingFrames(t *testing.T) {
+	s := newSession(t,
+		`{"offset":1,"partition":0,"body":{}}`,
+		`{"status":"alive"}`,
+		`{"partition":0,"body":{}}`,
+		`{"offset":2,"partition":0,"body":{}}`,
+	)
+	h := &recorder{}
+	store := eventbus.NewInMemoryOffsetStore()
+	errs := make(chan error, 10)
+	eb := newEventbus(t, s.Endpoint(), h, store, eventbus.WithErrorChannel(errs))
+	run(t, eb)
+
+	waitFor(t, "offset 2 to be committed", func() bool { return storedOffset(store, 0) == 2 })
+	if got := h.offsets(); !reflect.DeepEqual(got, []int64{1, 2}) {
+		t.Errorf("handled offsets = %v, want [1 2]", got)
+	}
+	select {
+	case err := <-errs:
+		if err != eventbus.ErrIncompleteFrame {
+			t.Errorf("logged %v, want ErrIncompleteFrame", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the frame without an offset was not reported")
+	}
+	if n := eb.ReconnectAttempts(); n != 0 {
+		t.Errorf("ReconnectAttempts() = %d, want 0", n)
+	}
+}
+
+func TestEmptyFrames(t *testing.T) {
+	s := newSession(t,
+		`{"offset":1,"partition":0,"body":{}}`,
+		``,
+		" \n",
+		`{"offset":2,"partition":0,"body":{}}`,
+	)
+	h := &recorder{}
+	store := eventbus.NewInMemoryOffsetStore()
+	eb := newEventbus(t, s.Endpoint(), h, store)
+	run(t, eb)
+
+	waitFor(t, "offset 2 to be committed", func() bool { return storedOffset(store, 0) == 2 })
+	if got := h.offsets(); !reflect.DeepEqual(got, []int64{1, 2}) {
+		t.Errorf("handled offsets = %v, want [1 2]", got)
+	}
+	if n := eb.ReconnectAttempts(); n != 0 {
+		t.Errorf("ReconnectAttempts() = %d, want 0", n)
+	}
+}
+
+func TestLargeOffsets(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame string
+		want  int64
+	}{
+		{"string", `{"offset":"9007199254740993","partition":0,"body":{}}`, 9007199254740993},
+		{"number", `{"offset":9007199254740995,"partition":0,"body":{}}`, 9007199254740995},
+		{"max string", `{"offset":"9223372036854775807","partition":0,"body":{}}`, math.MaxInt64},
+		{"max number", `{"offset":9223372036854775807,"partition":0,"body":{}}`, math.MaxInt64},
+		{"below max string", `{"offset":"9223372036854775806","partition":0,"body":{}}`, math.MaxInt64 - 1},
+		{"below max number", `{"offset":9223372036854775806,"partition":0,"body":{}}`, math.MaxInt64 - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSession(t, tt.frame)
+			h := &recorder{}
+			store := eventbus.NewInMemoryOffsetStore()
+			eb := newEventbus(t, s.Endpoint(), h, store)
+			run(t, eb)
+
+			waitFor(t, "the offset to be committed", func() bool { return storedOffset(store, 0) != -1 })
+			if got := h.offsets(); !reflect.DeepEqual(got, []int64{tt.want}) {
+				t.Errorf("handled offsets = %v, want [%d]", got, tt.want)
+			}
+			if got := storedOffset(store, 0); got != tt.want {
+				t.Errorf("stored offset = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMalformedOffset(t *testing.T) {
+	s := newSession(t, `{"offset":"12x","partition":0,"body":{}}`)
+	h := &recorder{}
+	errs := make(chan error, 10)
+	eb := newEventbus(t, s.Endpoint(), h, eventbus.NewInMemoryOffsetStore(), eventbus.WithErrorChannel(errs))
+	run(t, eb)
+
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), `parsing offset "12x"`) {
+			t.Errorf("logged %v, want an offset parse error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the malformed offset was not reported")
+	}
+	if got := h.offsets(); len(got) != 0 {
+		t.Errorf("handled offsets = %v, want none", got)
+	}
+}
+
+func TestMessageBeforeReady(t *testing.T) {
+	srv := eventbustest.NewServer(func(c *websocket.Conn) {
+		if err := c.WriteJSON(map[string]string{"id": "srv"}); err != nil {
+			return
+		}
+		var h map[string]string
+		if err := c.ReadJSON(&h); err != nil {
+			return
+		}
+		// No ready frame: the server starts streaming straight away.
+		for _, f := range []string{`{"offset":1,"partition":0,"body":{}}`, `{"offset":2,"partition":0,"body":{}}`} {
+			if err := c.WriteMessage(websocket.TextMessage, []byte(f)); err != nil {
+				return
+			}
+		}
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	defer srv.Close()
+	h := &recorder{}
+	store := eventbus.NewInMemoryOffsetStore()
+	eb := newEventbus(t, srv.Endpoint(), h, store)
+	run(t, eb)
+
+	waitFor(t, "offset 2 to be committed", func() bool { return storedOffset(store, 0) == 2 })
+	if got := h.offsets(); !reflect.DeepEqual(got, []int64{1, 2}) {
+		t.Errorf("handled offsets = %v, want the first message handled too, [1 2]", got)
+	}
+}
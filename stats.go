@@ -0,0 +1,78 @@
+package eventbus
+
+import (
+	"sync/atomic"
+)
+
+// ConnStats counts the frames and payload bytes passing over websocket
+// connections. Bytes are message payloads, excluding websocket framing and
+// control frames.
+type ConnStats struct {
+	FramesRead    int64
+	FramesWritten int64
+	BytesRead     int64
+	BytesWritten  int64
+}
+
+// ConnStats returns the traffic over every connection since the Eventbus was
+// created.
+func (eb *Eventbus) ConnStats() ConnStats {
+	return eb.stats.total.load()
+}
+
+// CurrentConnStats returns the traffic over the current or most recent
+// connection.
+func (eb *Eventbus) CurrentConnStats() ConnStats {
+	return eb.stats.current.load()
+}
+
+// connStats holds the counters behind ConnStats. It is allocated on its own so
+// the 64-bit counters are aligned for atomic access on 32-bit platforms.
+type connStats struct {
+	total   statCounters
+	current statCounters
+}
+
+type statCounters struct {
+	framesRead    int64
+	framesWritten int64
+	bytesRead     int64
+	bytesWritten  int64
+}
+
+func (c *statCounters) load() ConnStats {
+	return ConnStats{
+		FramesRead:    atomic.LoadInt64(&c.framesRead),
+		FramesWritten: atomic.LoadInt64(&c.framesWritten),
+		BytesRead:     atomic.LoadInt64(&c.bytesRead),
+		BytesWritten:  atomic.LoadInt64(&c.bytesWritten),
+	}
+}
+
+func (s *connStats) read(n int) {
+	s.total.read(n)
+	s.current.read(n)
+}
+
+func (s *connStats) wrote(n int) {
+	s.total.wrote(n)
+	s.current.wrote(n)
+}
+
+func (c *statCounters) read(n int) {
+	atomic.AddInt64(&c.framesRead, 1)
+	atomic.AddInt64(&c.bytesRead, int64(n))
+}
+
+func (c *statCounters) wrote(n int) {
+	atomic.AddInt64(&c.framesWritten, 1)
+	atomic.AddInt64(&c.bytesWritten, int64(n))
+}
+
+// connected starts counting a new connection.
+func (s *connStats) connected() {
+	atomic.StoreInt64(&s.current.framesRead, 0)
+	atomic.StoreInt64(&s.current.framesWritten, 0)
+	atomic.StoreInt64(&s.current.bytesRead, 0)
+	atomic.StoreInt64(&s.current.bytesWritten, 0)
+}
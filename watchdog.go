@@ -0,0 +1,96 @@
+package eventbus
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNoProgress is logged when no message has been handled within the
+// timeout given to WithProgressTimeout.
+var ErrNoProgress = errors.New("no progress while streaming")
+
+// WithProgressTimeout watches for connections that stay up while delivering
+// nothing: if no message has been handled for d while streaming, an error
+// wrapping ErrNoProgress is logged and, if reconnect is true, the connection
+// is dropped and a new one made as after any other connection failure. Time
+// spent in a handler, or paused by WithCircuitBreaker, does not count towards
+// d. Quiet streams also trip the timeout, so d should be well above the
+// longest expected gap between messages. A zero d, the default, disables the
+// watchdog.
+func WithProgressTimeout(d time.Duration, reconnect bool) Option {
+	return func(eb *Eventbus) {
+		eb.progressTimeout = d
+		eb.progressReconnect = reconnect
+	}
+}
+
+// startWatchdog starts watching the current connection for progress.
+func (eb *Eventbus) startWatchdog() {
+	if eb.progressTimeout <= 0 || eb.stopWatchdogs != nil {
+		return
+	}
+	socket := eb.socket
+	timeout := eb.progressTimeout
+	reconnect := eb.progressReconnect
+	quit := make(chan struct{})
+	eb.stopWatchdogs = quit
+	eb.mu.Lock()
+	eb.progressAt = eb.clock.Now()
+	eb.mu.Unlock()
+	go func() {
+		wait := timeout
+		for {
+			select {
+			case <-eb.clock.After(wait):
+			case <-quit:
+				return
+			}
+			eb.mu.Lock()
+			idle := eb.clock.Now().Sub(eb.progressAt)
+			stalled := !eb.handling && idle >= timeout
+			if stalled {
+				eb.progressAt = eb.clock.Now()
+			}
+			eb.mu.Unlock()
+			if !stalled {
+				// Wait out the rest of the timeout since the last progress.
+				if wait = timeout - idle; wait <= 0 {
+					wait = timeout
+				}
+				continue
+			}
+			wait = timeout
+			eb.logError(fmt.Errorf("%w: no message handled in %s", ErrNoProgress, idle))
+			if reconnect {
+				socket.Close()
+				return
+			}
+		}
+	}()
+}
+
+// stopWatchdog stops watching the current connection.
+func (eb *Eventbus) stopWatchdog() {
+	if eb.stopWatchdogs != nil {
+		close(eb.stopWatchdogs)
+		eb.stopWatchdogs = nil
+	}
+}
+
+// beginHandling marks a message as being handled, so the watchdog does not
+// count a slow handler as a stall. The returned func records the progress.
+func (eb *Eventbus) beginHandling() func() {
+	if eb.progressTimeout <= 0 {
+		return func() {}
+	}
+	eb.mu.Lock()
+	eb.handling = true
+	eb.mu.Unlock()
+	return func() {
+		eb.mu.Lock()
+		eb.handling = false
+		eb.progressAt = eb.clock.Now()
+		eb.mu.Unlock()
+	}
+}